@@ -1,13 +1,22 @@
 module deckyfileserver
 
-go 1.21
+go 1.22.2
 
-require github.com/u2takey/ffmpeg-go v0.5.0
+require (
+	github.com/HugoSmits86/nativewebp v0.9.3
+	github.com/dhowden/tag v0.0.0-20240417053706-3d75831295e8
+	github.com/disintegration/imaging v1.6.2
+	github.com/rwcarlsen/goexif v0.0.0-20190401172101-9e8deecbddbd
+	github.com/srwiley/oksvg v0.0.0-20221011165216-be6e8873101c
+	github.com/srwiley/rasterx v0.0.0-20220730225603-2ab79fcdd4ef
+	github.com/u2takey/ffmpeg-go v0.5.0
+	golang.org/x/image v0.0.0-20211028202545-6944b10bf410
+	golang.org/x/net v0.24.0
+)
 
 require (
 	github.com/aws/aws-sdk-go v1.38.20 // indirect
-	github.com/disintegration/imaging v1.6.2 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/u2takey/go-utils v0.3.1 // indirect
-	golang.org/x/image v0.0.0-20191009234506-e7c1f5e7dbb8 // indirect
+	golang.org/x/text v0.14.0 // indirect
 )
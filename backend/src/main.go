@@ -8,6 +8,8 @@ import (
 	_ "golang.org/x/image/webp"
 	"log"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 func main() {
@@ -16,13 +18,47 @@ func main() {
 	var timeout int
 	var verbose bool
 	var allowUploads bool
+	var allowWrite bool
 	var disableThumbnails bool
+	var disableSymlinks bool
+	var stateDir string
+	var certFile string
+	var keyFile string
+	var trashRetentionDays int
+	var trashMaxMB int64
+	var uploadDays int
+	var uploadRequestKB int64
+	var thumbCacheDays int
+	var thumbCacheMB int64
+	var thumbMemoryMB int64
+	var thumbWorkers int
+	var showGPS bool
+	var spriteFrames int
+	var boxArtDir string
+	var videoClipSeconds float64
 	flag.BoolVar(&verbose, "verbose", false, "log output to stdout (default: false)")
 	flag.StringVar(&rootFolder, "f", "/home/david", "Root folder to share")
 	flag.IntVar(&port, "p", 8000, "Port number to listen to")
 	flag.IntVar(&timeout, "t", 60, "Inactivity timeout (in seconds)")
 	flag.BoolVar(&allowUploads, "uploads", false, "Allow uploads from the web page (default: false)")
+	flag.BoolVar(&allowWrite, "write", false, "Allow creating, renaming, moving, copying and deleting files from the web page (default: false)")
 	flag.BoolVar(&disableThumbnails, "disablethumbnails", false, "Disable generating thumbnails for images & videos (default: false)")
+	flag.BoolVar(&disableSymlinks, "disablesymlinks", false, "Refuse to follow symlinks, even ones that stay inside the shared folder (default: false)")
+	flag.StringVar(&stateDir, "state", defaultStateDir(), "Folder to keep generated certificates and other server state in")
+	flag.StringVar(&certFile, "cert", "", "PEM certificate to use instead of the generated one (requires -key)")
+	flag.StringVar(&keyFile, "key", "", "PEM private key matching -cert")
+	flag.IntVar(&trashRetentionDays, "trashdays", 30, "Days to keep deleted files in the trash, 0 to keep them until the size limit is reached")
+	flag.Int64Var(&trashMaxMB, "trashsize", 2048, "Maximum size of the trash in MB, 0 for no limit")
+	flag.IntVar(&uploadDays, "uploaddays", 3, "Days to keep unfinished uploads so they can be resumed, 0 to keep them forever")
+	flag.Int64Var(&uploadRequestKB, "uploadrequest", 0, "Maximum size of a single upload request in KB, 0 for no limit")
+	flag.IntVar(&thumbCacheDays, "thumbdays", 30, "Days to keep unused thumbnails in the cache, 0 to keep them until the size limit is reached")
+	flag.Int64Var(&thumbCacheMB, "thumbsize", 256, "Maximum size of the thumbnail cache in MB, 0 for no limit")
+	flag.Int64Var(&thumbMemoryMB, "thumbmem", 32, "Memory to use for keeping recent thumbnails in MB, 0 for no limit")
+	flag.IntVar(&thumbWorkers, "thumbworkers", 0, "Number of thumbnails to generate at once, 0 to use half the CPU cores")
+	flag.BoolVar(&showGPS, "exifgps", false, "Include the GPS location stored in photos when showing their details (default: false)")
+	flag.IntVar(&spriteFrames, "spriteframes", 0, "Frames to put in the hover preview of videos, 0 to disable (requires ffmpeg)")
+	flag.StringVar(&boxArtDir, "boxart", "", "Folder of cover images to use as thumbnails for ROMs, named after the ROM")
+	flag.Float64Var(&videoClipSeconds, "videoclip", 0, "Seconds of video to use for animated thumbnails, 0 to use a still (requires ffmpeg)")
 	flag.Parse()
 
 	logger.SetupLogger("/tmp/deckyfileserver.log", verbose)
@@ -36,19 +72,47 @@ func main() {
 		log.Println(fmt.Sprintf("[ERROR]: Folder %s cannot be read or does not exist", rootFolder))
 		os.Exit(1)
 	}
+	if (certFile == "") != (keyFile == "") {
+		log.Println("[ERROR]: -cert and -key must be provided together")
+		os.Exit(1)
+	}
 	if port < 1024 || port > 65535 {
 		fmt.Println("[ERROR]: Port must be between 1024-65535")
 		os.Exit(1)
 	}
 
 	s := server.Server{
-		Uploads:    allowUploads,
+		Uploads:              allowUploads,
+		AllowWrite:           allowWrite,
 		DisableThumbnails:    disableThumbnails,
-		Port:       port,
-		Timeout:    timeout,
-		RootFolder: rootFolder,
-		UploadJobs: map[string]string{},
+		Port:                 port,
+		Timeout:              timeout,
+		RootFolder:           rootFolder,
+		DisableSymlinks:      disableSymlinks,
+		StateDir:             stateDir,
+		CertFile:             certFile,
+		KeyFile:              keyFile,
+		TrashRetention:       time.Duration(trashRetentionDays) * 24 * time.Hour,
+		TrashMaxBytes:        trashMaxMB << 20,
+		UploadExpiry:         time.Duration(uploadDays) * 24 * time.Hour,
+		UploadRequestBytes:   uploadRequestKB << 10,
+		ThumbnailCacheAge:    time.Duration(thumbCacheDays) * 24 * time.Hour,
+		ThumbnailCacheBytes:  thumbCacheMB << 20,
+		ThumbnailMemoryBytes: thumbMemoryMB << 20,
+		ThumbnailWorkers:     thumbWorkers,
+		ShowGPS:              showGPS,
+		SpriteFrames:         spriteFrames,
+		BoxArtDir:            boxArtDir,
+		VideoClipSeconds:     videoClipSeconds,
 	}
 
 	s.Start()
 }
+
+func defaultStateDir() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "deckyfileserver")
+	}
+	return filepath.Join(configDir, "deckyfileserver")
+}
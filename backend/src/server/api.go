@@ -0,0 +1,191 @@
+package server
+
+import (
+	"deckyfileserver/thumbnail"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+type APIError struct {
+	Error string `json:"error"`
+}
+
+type ServerInfo struct {
+	Root             string               `json:"root"`
+	UploadsEnabled   bool                 `json:"uploadsEnabled"`
+	Thumbnails       bool                 `json:"thumbnails"`
+	Timeout          int                  `json:"timeout"`
+	TimeoutRemaining int                  `json:"timeoutRemaining"`
+	Fingerprint      string               `json:"fingerprint"`
+	ThumbnailCache   thumbnail.CacheStats `json:"thumbnailCache"`
+}
+
+type ThumbnailStatus struct {
+	Path      string `json:"path"`
+	Available bool   `json:"available"`
+	Ready     bool   `json:"ready"`
+	URL       string `json:"url,omitempty"`
+}
+
+// SpriteIndex tells the listing where to find each frame of a video's hover
+// preview in the sprite sheet at URL.
+type SpriteIndex struct {
+	thumbnail.SpriteLayout
+	Path string `json:"path"`
+	URL  string `json:"url"`
+}
+
+type UploadStatus struct {
+	ID            string      `json:"id"`
+	Name          string      `json:"name"`
+	URL           string      `json:"url"`
+	State         UploadState `json:"state"`
+	BytesReceived FileSize    `json:"bytesReceived"`
+	Size          FileSize    `json:"size"`
+	Updated       time.Time   `json:"updated"`
+	// Expires is left out for uploads that never expire
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("[ERROR]: writeJSON:", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, APIError{Error: message})
+}
+
+func writeAPIResolveError(w http.ResponseWriter, endpoint string, err error) {
+	status := resolveErrorStatus(err)
+	if status != http.StatusNotFound {
+		log.Printf("[ERROR]: endpoint '%s': %v", endpoint, err)
+	}
+	writeAPIError(w, status, http.StatusText(status))
+}
+
+func (s *Server) registerAPI(serveMux *http.ServeMux) {
+	serveMux.HandleFunc("/api/v1/files/", s.handleAPIFiles)
+	serveMux.HandleFunc("/api/v1/stat/", s.handleAPIStat)
+	serveMux.HandleFunc("/api/v1/thumbnail/", s.handleAPIThumbnail)
+	serveMux.HandleFunc("/api/v1/sprite/", s.handleAPISprite)
+	serveMux.HandleFunc("/api/v1/info", s.handleAPIInfo)
+	serveMux.HandleFunc("/api/v1/uploads", s.handleAPIUploads)
+}
+
+// statRequestPath resolves an API path (relative to RootFolder) to the same
+// DirEntry the HTML listing would render for it.
+func (s *Server) statRequestPath(relPath string) (DirEntry, string, error) {
+	diskPath, err := s.ResolvePath(relPath)
+	if err != nil {
+		return DirEntry{}, "", err
+	}
+	info, err := os.Stat(diskPath)
+	if err != nil {
+		return DirEntry{}, "", err
+	}
+	return newDirEntry(info, path.Join("/files", relPath), s), diskPath, nil
+}
+
+func (s *Server) handleAPIFiles(w http.ResponseWriter, r *http.Request) {
+	relPath := strings.TrimPrefix(r.URL.Path, "/api/v1/files")
+	entry, diskPath, err := s.statRequestPath(relPath)
+	if err != nil {
+		writeAPIResolveError(w, "/api/v1/files/", err)
+		return
+	}
+	if !entry.IsDir {
+		writeJSON(w, http.StatusOK, entry)
+		return
+	}
+	requestPath := path.Join("/files", relPath) + "/"
+	dirData, err := getDir(diskPath, requestPath, parseListOptions(r.URL.Query()), s)
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, dirData)
+}
+
+func (s *Server) handleAPIStat(w http.ResponseWriter, r *http.Request) {
+	entry, _, err := s.statRequestPath(strings.TrimPrefix(r.URL.Path, "/api/v1/stat"))
+	if err != nil {
+		writeAPIResolveError(w, "/api/v1/stat/", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
+
+func (s *Server) handleAPIThumbnail(w http.ResponseWriter, r *http.Request) {
+	entry, diskPath, err := s.statRequestPath(strings.TrimPrefix(r.URL.Path, "/api/v1/thumbnail"))
+	if err != nil {
+		writeAPIResolveError(w, "/api/v1/thumbnail/", err)
+		return
+	}
+	status := ThumbnailStatus{Path: entry.Path, Available: entry.Thumbnail}
+	if entry.Thumbnail {
+		status.URL = "/preview" + entry.Path
+		status.Ready = thumbGen.IsReady(diskPath, thumbnail.DefaultOptions)
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *Server) handleAPISprite(w http.ResponseWriter, r *http.Request) {
+	entry, _, err := s.statRequestPath(strings.TrimPrefix(r.URL.Path, "/api/v1/sprite"))
+	if err != nil {
+		writeAPIResolveError(w, "/api/v1/sprite/", err)
+		return
+	}
+	if !entry.Sprite {
+		writeAPIError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	writeJSON(w, http.StatusOK, SpriteIndex{
+		SpriteLayout: thumbGen.Sprites,
+		Path:         entry.Path,
+		URL:          "/preview" + entry.Path + "?sprite=true",
+	})
+}
+
+func (s *Server) handleAPIInfo(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ServerInfo{
+		Root:             s.RootFolder,
+		UploadsEnabled:   s.Uploads,
+		Thumbnails:       !s.DisableThumbnails,
+		Timeout:          s.Timeout,
+		TimeoutRemaining: int(s.TimeoutRemaining().Seconds()),
+		Fingerprint:      s.CertFingerprint,
+		ThumbnailCache:   thumbGen.Cache.Stats(),
+	})
+}
+
+func (s *Server) handleAPIUploads(w http.ResponseWriter, r *http.Request) {
+	uploads := make([]UploadStatus, 0)
+	if s.Uploads && s.uploadManager != nil {
+		for _, upload := range s.uploadManager.List() {
+			state, offset, updated := upload.Progress()
+			status := UploadStatus{
+				ID:            upload.ID,
+				Name:          upload.FileName,
+				URL:           tusEndpoint + upload.ID,
+				State:         state,
+				BytesReceived: FileSize(offset),
+				Size:          FileSize(upload.Length),
+				Updated:       updated,
+			}
+			if expires := s.uploadManager.Expires(upload); !expires.IsZero() {
+				status.Expires = &expires
+			}
+			uploads = append(uploads, status)
+		}
+	}
+	writeJSON(w, http.StatusOK, uploads)
+}
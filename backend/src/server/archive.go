@@ -0,0 +1,228 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type archiveWriter interface {
+	AddFile(name string, info fs.FileInfo, diskPath string) error
+	AddDir(name string, info fs.FileInfo) error
+	Close() error
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (z *zipArchive) AddFile(name string, info fs.FileInfo, diskPath string) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	writer, err := z.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	return copyFileTo(writer, diskPath)
+}
+
+func (z *zipArchive) AddDir(name string, info fs.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+	_, err = z.zw.CreateHeader(header)
+	return err
+}
+
+func (z *zipArchive) Close() error {
+	return z.zw.Close()
+}
+
+type tarGzArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (t *tarGzArchive) AddFile(name string, info fs.FileInfo, diskPath string) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := t.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	return copyFileTo(t.tw, diskPath)
+}
+
+func (t *tarGzArchive) AddDir(name string, info fs.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+	return t.tw.WriteHeader(header)
+}
+
+func (t *tarGzArchive) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+func copyFileTo(w io.Writer, diskPath string) error {
+	file, err := os.Open(diskPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+func newArchiveWriter(format string, w io.Writer) (archiveWriter, string, error) {
+	switch format {
+	case "", "zip":
+		return &zipArchive{zw: zip.NewWriter(w)}, ".zip", nil
+	case "tar.gz", "tgz":
+		gz := gzip.NewWriter(w)
+		return &tarGzArchive{gz: gz, tw: tar.NewWriter(gz)}, ".tar.gz", nil
+	}
+	return nil, "", fmt.Errorf("unsupported archive format: %s", format)
+}
+
+// handleArchive streams /archive/files/<dir> as a zip or tar.gz. Passing one
+// or more "entry" query params restricts the archive to those children of the
+// directory.
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	showHidden := r.URL.Query().Get("hidden") == "true"
+	relDir := strings.TrimPrefix(r.URL.Path, "/archive/files")
+	dirPath, resolveErr := s.ResolvePath(relDir)
+	if resolveErr != nil {
+		WriteResolveError(w, "/archive/", resolveErr)
+		return
+	}
+	stat, err := os.Stat(dirPath)
+	if err != nil || !stat.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	entries := r.URL.Query()["entry"]
+	for _, entry := range entries {
+		if entry == "" || entry == "." || strings.ContainsAny(entry, "/\\") {
+			WriteResolveError(w, "/archive/", ErrForbiddenPath)
+			return
+		}
+		if _, err := s.ResolvePath(path.Join(relDir, entry)); err != nil {
+			WriteResolveError(w, "/archive/", err)
+			return
+		}
+	}
+
+	archive, ext, err := newArchiveWriter(r.URL.Query().Get("format"), w)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	archiveName := filepath.Base(dirPath)
+	if path.Clean("/"+relDir) == "/" {
+		archiveName = "files"
+	}
+	log.Println("[INFO]: endpoint '/archive/': streaming", dirPath, "as", ext)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", archiveName+ext))
+
+	stopKeepAlive := s.keepAliveWhileRunning()
+	defer stopKeepAlive()
+
+	roots := []string{"."}
+	if len(entries) > 0 {
+		roots = entries
+	}
+	for _, root := range roots {
+		if err := s.addToArchive(r.Context(), archive, relDir, root, showHidden); err != nil {
+			log.Println("[ERROR]: endpoint '/archive/':", err)
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Println("[ERROR]: endpoint '/archive/':", err)
+	}
+}
+
+func (s *Server) addToArchive(ctx context.Context, archive archiveWriter, relDir string, root string, showHidden bool) error {
+	rootPath, err := s.ResolvePath(path.Join(relDir, root))
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(rootPath, func(diskPath string, d fs.DirEntry, walkErr error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if walkErr != nil {
+			log.Println("[ERROR]: endpoint '/archive/': skipping", diskPath, walkErr)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(rootPath, diskPath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(filepath.Join(root, rel))
+		if rel == "." && root == "." {
+			return nil
+		}
+		if !showHidden && strings.HasPrefix(d.Name(), ".") && diskPath != rootPath {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() && s.inStateDir(diskPath) {
+			return fs.SkipDir
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			target, err := s.ResolvePath(path.Join(relDir, name))
+			if err != nil {
+				return nil
+			}
+			info, err := os.Stat(target)
+			if err != nil || !info.Mode().IsRegular() {
+				return nil
+			}
+			return archive.AddFile(name, info, target)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			return archive.AddDir(name, info)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return archive.AddFile(name, info, diskPath)
+	})
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionCookieName = "dfs_session"
+const maxPinAttempts = 5
+
+type SessionStore struct {
+	mu             sync.Mutex
+	secret         []byte
+	pin            string
+	failedAttempts int
+	ttl            time.Duration
+	sessions       map[string]time.Time
+}
+
+type PairTemplateData struct {
+	Next        string
+	Error       string
+	Fingerprint string
+}
+
+type ConnectTemplateData struct {
+	Host         string
+	Password     string
+	AllowUploads bool
+}
+
+func NewSessionStore(ttl time.Duration) (*SessionStore, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	store := &SessionStore{
+		secret:   secret,
+		ttl:      ttl,
+		sessions: map[string]time.Time{},
+	}
+	if err := store.rotatePin(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// rotatePin must be called with the lock held (or before the store is shared).
+func (ss *SessionStore) rotatePin() error {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return err
+	}
+	ss.pin = fmt.Sprintf("%06d", n.Int64())
+	ss.failedAttempts = 0
+	// The Decky backend reads this line from stdout to show the PIN in the panel.
+	fmt.Printf("PIN: %s\n", ss.pin)
+	return nil
+}
+
+func (ss *SessionStore) Pin() string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.pin
+}
+
+// checkPin must be called with the lock held.
+func (ss *SessionStore) checkPin(pin string) error {
+	if subtle.ConstantTimeCompare([]byte(pin), []byte(ss.pin)) != 1 {
+		ss.failedAttempts++
+		if ss.failedAttempts >= maxPinAttempts {
+			log.Println("[INFO]: Too many failed pairing attempts, generating a new PIN")
+			if err := ss.rotatePin(); err != nil {
+				return err
+			}
+		}
+		return fmt.Errorf("invalid PIN")
+	}
+	ss.failedAttempts = 0
+	return nil
+}
+
+// Pair exchanges the PIN for a session token. The PIN only works once, a new
+// one is shown on the panel for the next device.
+func (ss *SessionStore) Pair(pin string) (string, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if err := ss.checkPin(pin); err != nil {
+		return "", err
+	}
+	token, err := ss.newSession()
+	if err != nil {
+		return "", err
+	}
+	if err := ss.rotatePin(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Issue creates a session for an already paired device to hand to clients
+// such as WebDAV, which send the token as their Basic auth password.
+func (ss *SessionStore) Issue() (string, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.newSession()
+}
+
+// newSession must be called with the lock held.
+func (ss *SessionStore) newSession() (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(idBytes)
+	ss.sessions[id] = time.Now()
+	return id + "." + ss.sign(id), nil
+}
+
+func (ss *SessionStore) sign(id string) string {
+	mac := hmac.New(sha256.New, ss.secret)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (ss *SessionStore) sessionID(token string) (string, bool) {
+	id, sig, found := strings.Cut(token, ".")
+	if !found {
+		return "", false
+	}
+	if !hmac.Equal([]byte(sig), []byte(ss.sign(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+func (ss *SessionStore) Validate(token string) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	id, ok := ss.sessionID(token)
+	if !ok {
+		return false
+	}
+	lastSeen, exists := ss.sessions[id]
+	if !exists {
+		return false
+	}
+	if time.Since(lastSeen) > ss.ttl {
+		delete(ss.sessions, id)
+		return false
+	}
+	ss.sessions[id] = time.Now()
+	return true
+}
+
+func (ss *SessionStore) Revoke(token string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if id, ok := ss.sessionID(token); ok {
+		delete(ss.sessions, id)
+	}
+}
+
+func (ss *SessionStore) RevokeAll() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.sessions = map[string]time.Time{}
+}
+
+func isPublicPath(p string) bool {
+	return p == "/pair" || strings.HasPrefix(p, "/static/")
+}
+
+func (s *Server) requireSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if cookie, err := r.Cookie(sessionCookieName); err == nil && s.Sessions.Validate(cookie.Value) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/dav/") || strings.HasPrefix(r.URL.Path, tusEndpoint) {
+			if _, password, ok := r.BasicAuth(); ok && s.Sessions.Validate(password) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="DeckyFileServer"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/api/") {
+			writeAPIError(w, http.StatusUnauthorized, "not paired")
+			return
+		}
+		pairURL := "/pair?next=" + url.QueryEscape(r.URL.RequestURI())
+		if r.Header.Get("HX-Request") == "true" {
+			w.Header().Set("HX-Redirect", pairURL)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		http.Redirect(w, r, pairURL, http.StatusFound)
+	})
+}
+
+func safeRedirectTarget(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/files/"
+	}
+	return next
+}
+
+func (s *Server) handlePair(w http.ResponseWriter, r *http.Request) {
+	data := PairTemplateData{
+		Next:        safeRedirectTarget(r.URL.Query().Get("next")),
+		Fingerprint: s.CertFingerprint,
+	}
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data.Next = safeRedirectTarget(r.PostForm.Get("next"))
+		token, err := s.Sessions.Pair(strings.TrimSpace(r.PostForm.Get("pin")))
+		if err == nil {
+			log.Println("[INFO]: endpoint '/pair': paired", r.RemoteAddr)
+			http.SetCookie(w, &http.Cookie{
+				Name:     sessionCookieName,
+				Value:    token,
+				Path:     "/",
+				HttpOnly: true,
+				Secure:   true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			http.Redirect(w, r, data.Next, http.StatusSeeOther)
+			return
+		}
+		log.Println("[INFO]: endpoint '/pair': failed attempt from", r.RemoteAddr)
+		data.Error = "Incorrect PIN"
+		w.WriteHeader(http.StatusUnauthorized)
+	} else if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	t := parseTemplates("templates/pair.html")
+	if err := t.Execute(w, data); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
+	password, err := s.Sessions.Issue()
+	if err != nil {
+		log.Println("[ERROR]: endpoint '/connect':", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	data := ConnectTemplateData{
+		Host:         r.Host,
+		Password:     password,
+		AllowUploads: s.Uploads,
+	}
+	t := parseTemplates("templates/connect.html")
+	if err := t.Execute(w, data); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("all") == "true" {
+		log.Println("[INFO]: endpoint '/logout': revoking all sessions")
+		s.Sessions.RevokeAll()
+	} else if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		s.Sessions.Revoke(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Redirect", "/pair")
+		return
+	}
+	http.Redirect(w, r, "/pair", http.StatusSeeOther)
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"golang.org/x/net/webdav"
+)
+
+// davFS exposes RootFolder to webdav.Handler, sending every name through
+// ResolvePath so WebDAV is confined exactly like /files/.
+type davFS struct {
+	server      *Server
+	allowCreate bool
+	allowModify bool
+}
+
+type davFile struct {
+	*os.File
+	fs      *davFS
+	relPath string
+}
+
+func (d *davFS) resolve(name string) (string, error) {
+	resolved, err := d.server.ResolvePath(name)
+	if errors.Is(err, ErrForbiddenPath) {
+		return "", os.ErrPermission
+	}
+	return resolved, err
+}
+
+// resolveEntry is resolve for operations on the entry itself, which must not
+// follow a final symlink.
+func (d *davFS) resolveEntry(name string, mustExist bool) (string, error) {
+	var resolved string
+	var err error
+	if mustExist {
+		resolved, err = d.server.resolveExisting(name)
+	} else {
+		resolved, err = d.server.resolveEntry(name)
+	}
+	if errors.Is(err, ErrForbiddenPath) {
+		return "", os.ErrPermission
+	}
+	return resolved, err
+}
+
+func (d *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if !d.allowCreate {
+		return os.ErrPermission
+	}
+	resolved, err := d.resolve(name)
+	if err != nil {
+		return err
+	}
+	if err := checkNewName(name); err != nil {
+		return err
+	}
+	return os.Mkdir(resolved, perm)
+}
+
+func (d *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if write && !d.allowCreate {
+		return nil, os.ErrPermission
+	}
+	resolved, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if write {
+		replaced, err := d.prepareWrite(resolved, name)
+		if err != nil {
+			return nil, err
+		}
+		if replaced {
+			flag |= os.O_CREATE
+		}
+	}
+	file, err := os.OpenFile(resolved, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{File: file, fs: d, relPath: name}, nil
+}
+
+// prepareWrite lets uploads create new files, but only replaces an existing
+// one when file management is allowed, moving the old copy to the trash first.
+func (d *davFS) prepareWrite(resolved string, name string) (bool, error) {
+	info, err := os.Lstat(resolved)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, checkNewName(name)
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.IsDir() || !d.allowModify {
+		log.Println("[INFO]: endpoint '/dav/': refusing to overwrite", resolved)
+		return false, os.ErrPermission
+	}
+	log.Println("[INFO]: endpoint '/dav/': replacing", resolved)
+	if _, err := d.server.Trash.Add(resolved, name); err != nil {
+		if errors.Is(err, ErrTooLargeForTrash) {
+			log.Println("[INFO]: endpoint '/dav/': refusing to replace", err)
+			return false, os.ErrPermission
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// checkNewName refuses names that SanitizeFileName would have to change, as
+// WebDAV clients expect the entry to appear under the name they sent.
+func checkNewName(name string) error {
+	base := path.Base(name)
+	if sanitized, err := SanitizeFileName(base); err != nil || sanitized != base {
+		log.Println("[INFO]: endpoint '/dav/': refusing to create", name)
+		return os.ErrPermission
+	}
+	return nil
+}
+
+func (d *davFS) RemoveAll(ctx context.Context, name string) error {
+	if !d.allowModify {
+		return os.ErrPermission
+	}
+	resolved, err := d.resolveEntry(name, true)
+	if err != nil {
+		return err
+	}
+	// Deletes can't be confirmed over WebDAV, so anything too large for the
+	// trash is refused rather than lost
+	log.Println("[INFO]: endpoint '/dav/': deleting", resolved)
+	if _, err := d.server.Trash.Add(resolved, name); err != nil {
+		if errors.Is(err, ErrTooLargeForTrash) {
+			log.Println("[INFO]: endpoint '/dav/': refusing to delete", err)
+			return os.ErrPermission
+		}
+		return err
+	}
+	return nil
+}
+
+func (d *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	if !d.allowModify {
+		return os.ErrPermission
+	}
+	oldPath, err := d.resolveEntry(oldName, true)
+	if err != nil {
+		return err
+	}
+	newPath, err := d.resolveEntry(newName, false)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (d *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	resolved, err := d.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(resolved)
+}
+
+type namedFileInfo struct {
+	fs.FileInfo
+	name string
+}
+
+func (n namedFileInfo) Name() string {
+	return n.name
+}
+
+// Readdir hides symlinks that ResolvePath would refuse to follow, and StateDir.
+func (f *davFile) Readdir(count int) ([]fs.FileInfo, error) {
+	infos, err := f.File.Readdir(count)
+	allowed := infos[:0]
+	for _, info := range infos {
+		if info.Mode()&fs.ModeSymlink != 0 || info.IsDir() {
+			target, resolveErr := f.fs.resolve(path.Join(f.relPath, info.Name()))
+			if resolveErr != nil {
+				continue
+			}
+			if targetInfo, statErr := os.Stat(target); statErr == nil {
+				info = namedFileInfo{FileInfo: targetInfo, name: info.Name()}
+			}
+		}
+		allowed = append(allowed, info)
+	}
+	return allowed, err
+}
+
+func (s *Server) davHandler() http.Handler {
+	handler := &webdav.Handler{
+		Prefix:     "/dav",
+		FileSystem: &davFS{server: s, allowCreate: s.Uploads, allowModify: s.AllowWrite},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("[ERROR]: endpoint '/dav/': %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stopKeepAlive := s.keepAliveWhileRunning()
+		defer stopKeepAlive()
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"deckyfileserver/thumbnail"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+type DetailsTemplateData struct {
+	Entry    DirEntry
+	Metadata thumbnail.ImageMetadata
+}
+
+func (d DirEntry) IsImage() bool {
+	return strings.HasPrefix(d.MimeType, "image/")
+}
+
+func (s *Server) registerDetails(serveMux *http.ServeMux) {
+	serveMux.HandleFunc("/details", s.handleDetails)
+	serveMux.HandleFunc("/api/v1/exif/", s.handleAPIExif)
+}
+
+func (s *Server) handleDetails(w http.ResponseWriter, r *http.Request) {
+	entry, diskPath, err := s.statRequestPath(r.URL.Query().Get("path"))
+	if err != nil {
+		WriteResolveError(w, "/details", err)
+		return
+	}
+	data := DetailsTemplateData{Entry: entry}
+	if entry.IsImage() {
+		data.Metadata, err = thumbnail.ReadImageMetadata(diskPath, s.ShowGPS)
+		if err != nil && !errors.Is(err, thumbnail.ErrNotAnImage) {
+			log.Println("[ERROR]: endpoint '/details':", err)
+		}
+	}
+	t := parseTemplates("templates/details.html")
+	if err := t.Execute(w, data); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Server) handleAPIExif(w http.ResponseWriter, r *http.Request) {
+	entry, diskPath, err := s.statRequestPath(strings.TrimPrefix(r.URL.Path, "/api/v1/exif"))
+	if err != nil {
+		writeAPIResolveError(w, "/api/v1/exif/", err)
+		return
+	}
+	if entry.IsDir {
+		writeAPIError(w, http.StatusBadRequest, thumbnail.ErrNotAnImage.Error())
+		return
+	}
+	metadata, err := thumbnail.ReadImageMetadata(diskPath, s.ShowGPS)
+	if errors.Is(err, thumbnail.ErrNotAnImage) {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, metadata)
+}
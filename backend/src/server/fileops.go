@@ -0,0 +1,424 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+var ErrDestinationExists = errors.New("destination already exists")
+var ErrInvalidName = errors.New("invalid file name")
+var ErrNotAFolder = errors.New("destination is not a folder")
+var ErrSymlinkLoop = errors.New("symlink points back into the folder being copied")
+
+// FileOpRequest is accepted as JSON, as form values or as query params. For
+// requests made from the row menu, Name or Destination come from HX-Prompt.
+type FileOpRequest struct {
+	Path        string `json:"path"`
+	Name        string `json:"name"`
+	Destination string `json:"destination"`
+	// Permanent deletes skip the trash, which is the only way to delete
+	// entries larger than it
+	Permanent bool `json:"permanent"`
+}
+
+type ActionsTemplateData struct {
+	Entry DirEntry
+}
+
+func (d DirEntry) RelPath() string {
+	return strings.TrimPrefix(d.Path, "/files")
+}
+
+func readFileOpRequest(r *http.Request) (FileOpRequest, error) {
+	var req FileOpRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, err
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return req, err
+		}
+		req.Path = r.Form.Get("path")
+		req.Name = r.Form.Get("name")
+		req.Destination = r.Form.Get("destination")
+		req.Permanent = r.Form.Get("permanent") == "true"
+	}
+	if prompt := r.Header.Get("HX-Prompt"); prompt != "" {
+		if req.Name == "" {
+			req.Name = prompt
+		}
+		if req.Destination == "" {
+			req.Destination = prompt
+		}
+	}
+	return req, nil
+}
+
+func ValidateFileName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+// reservedNames can't be used as file names on Windows or on FAT and exFAT
+// cards, with or without an extension.
+var reservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// SanitizeFileName makes a name sent by a client safe to create, replacing
+// path separators and control characters and prefixing reserved names with an
+// underscore. Names that can't be fixed up that way are rejected.
+func SanitizeFileName(name string) (string, error) {
+	name = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(strings.TrimSpace(name), ".")
+	if len(name) > 255 {
+		return "", ErrInvalidName
+	}
+	if err := ValidateFileName(name); err != nil {
+		return "", err
+	}
+	base, _, _ := strings.Cut(name, ".")
+	if slices.Contains(reservedNames, strings.ToUpper(strings.TrimSpace(base))) {
+		name = "_" + name
+	}
+	return name, nil
+}
+
+func fileOpErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrDestinationExists):
+		return http.StatusConflict
+	case errors.Is(err, ErrInvalidName), errors.Is(err, ErrNotAFolder), errors.Is(err, ErrSymlinkLoop):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrTooLargeForTrash):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, os.ErrPermission):
+		return http.StatusForbidden
+	}
+	return resolveErrorStatus(err)
+}
+
+func (s *Server) registerFileOps(serveMux *http.ServeMux) {
+	serveMux.HandleFunc("/actions", s.handleActions)
+	serveMux.HandleFunc("/api/v1/mkdir", s.fileOpHandler("mkdir", s.opMkdir))
+	serveMux.HandleFunc("/api/v1/rename", s.fileOpHandler("rename", s.opRename))
+	serveMux.HandleFunc("/api/v1/move", s.fileOpHandler("move", s.opMove))
+	serveMux.HandleFunc("/api/v1/copy", s.fileOpHandler("copy", s.opCopy))
+	serveMux.HandleFunc("/api/v1/delete", s.fileOpHandler("delete", s.opDelete))
+}
+
+// fileOpHandler wraps an operation with the checks shared by every write
+// endpoint, and answers with the resulting entry (if any) as JSON.
+func (s *Server) fileOpHandler(name string, op func(FileOpRequest, *http.Request) (string, error)) http.HandlerFunc {
+	endpoint := "/api/v1/" + name
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.AllowWrite {
+			writeAPIError(w, http.StatusForbidden, "file management is disabled")
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, "use POST")
+			return
+		}
+		req, err := readFileOpRequest(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		stopKeepAlive := s.keepAliveWhileRunning()
+		resultPath, err := op(req, r)
+		stopKeepAlive()
+		if err != nil {
+			status := fileOpErrorStatus(err)
+			log.Printf("[ERROR]: endpoint '%s': %v", endpoint, err)
+			writeAPIError(w, status, err.Error())
+			return
+		}
+		if r.Header.Get("HX-Request") == "true" {
+			w.Header().Set("HX-Refresh", "true")
+		}
+		if resultPath == "" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		entry, _, err := s.statRequestPath(resultPath)
+		if err != nil {
+			writeAPIResolveError(w, endpoint, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+	}
+}
+
+// resolveEntry resolves the entry at relPath itself: the parent folder is
+// resolved but a final symlink is not followed, so operations act on the link
+// rather than its target. The shared root can never be renamed, moved or
+// deleted, and neither can StateDir or a folder holding it.
+func (s *Server) resolveEntry(relPath string) (string, error) {
+	cleanPath := path.Clean("/" + relPath)
+	if cleanPath == "/" {
+		return "", os.ErrPermission
+	}
+	parent, err := s.ResolvePath(path.Dir(cleanPath))
+	if err != nil {
+		return "", err
+	}
+	diskPath := filepath.Join(parent, path.Base(cleanPath))
+	if state := s.stateDir(); state != "" && (isWithin(state, diskPath) || isWithin(diskPath, state)) {
+		return "", ErrForbiddenPath
+	}
+	return diskPath, nil
+}
+
+// resolveExisting is resolveEntry for entries that must exist.
+func (s *Server) resolveExisting(relPath string) (string, error) {
+	diskPath, err := s.resolveEntry(relPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(diskPath); err != nil {
+		return "", err
+	}
+	return diskPath, nil
+}
+
+// resolveTarget resolves a path that must not exist yet.
+func (s *Server) resolveTarget(relPath string) (string, error) {
+	diskPath, err := s.ResolvePath(relPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(diskPath); err == nil {
+		return "", ErrDestinationExists
+	}
+	return diskPath, nil
+}
+
+func (s *Server) opMkdir(req FileOpRequest, r *http.Request) (string, error) {
+	if err := ValidateFileName(req.Name); err != nil {
+		return "", err
+	}
+	relPath := path.Join("/", req.Path, req.Name)
+	diskPath, err := s.resolveTarget(relPath)
+	if err != nil {
+		return "", err
+	}
+	log.Println("[INFO]: endpoint '/api/v1/mkdir':", diskPath)
+	return relPath, os.Mkdir(diskPath, 0755)
+}
+
+func (s *Server) opRename(req FileOpRequest, r *http.Request) (string, error) {
+	if err := ValidateFileName(req.Name); err != nil {
+		return "", err
+	}
+	from, err := s.resolveExisting(req.Path)
+	if err != nil {
+		return "", err
+	}
+	relPath := path.Join(path.Dir(path.Join("/", req.Path)), req.Name)
+	to, err := s.resolveTarget(relPath)
+	if err != nil {
+		return "", err
+	}
+	log.Println("[INFO]: endpoint '/api/v1/rename':", from, "=>", to)
+	return relPath, os.Rename(from, to)
+}
+
+// destinationFor resolves where req.Path ends up inside the req.Destination
+// folder, refusing to place a folder inside itself.
+func (s *Server) destinationFor(req FileOpRequest) (string, string, string, error) {
+	from, err := s.resolveExisting(req.Path)
+	if err != nil {
+		return "", "", "", err
+	}
+	destDir, err := s.ResolvePath(req.Destination)
+	if err != nil {
+		return "", "", "", err
+	}
+	if stat, err := os.Stat(destDir); err != nil || !stat.IsDir() {
+		return "", "", "", fmt.Errorf("%w: %s", ErrNotAFolder, req.Destination)
+	}
+	if isWithin(from, destDir) {
+		return "", "", "", os.ErrPermission
+	}
+	relPath := path.Join("/", req.Destination, path.Base(path.Join("/", req.Path)))
+	to, err := s.resolveTarget(relPath)
+	if err != nil {
+		return "", "", "", err
+	}
+	return from, to, relPath, nil
+}
+
+func (s *Server) opMove(req FileOpRequest, r *http.Request) (string, error) {
+	from, to, relPath, err := s.destinationFor(req)
+	if err != nil {
+		return "", err
+	}
+	log.Println("[INFO]: endpoint '/api/v1/move':", from, "=>", to)
+	err = os.Rename(from, to)
+	if errors.Is(err, syscall.EXDEV) {
+		if err = s.copyTree(r, from, to, req.Path); err == nil {
+			err = os.RemoveAll(from)
+		}
+	}
+	return relPath, err
+}
+
+func (s *Server) opCopy(req FileOpRequest, r *http.Request) (string, error) {
+	if _, err := s.ResolvePath(req.Path); err != nil {
+		return "", err
+	}
+	from, to, relPath, err := s.destinationFor(req)
+	if err != nil {
+		return "", err
+	}
+	log.Println("[INFO]: endpoint '/api/v1/copy':", from, "=>", to)
+	return relPath, s.copyTree(r, from, to, req.Path)
+}
+
+func (s *Server) opDelete(req FileOpRequest, r *http.Request) (string, error) {
+	diskPath, err := s.resolveExisting(req.Path)
+	if err != nil {
+		return "", err
+	}
+	if req.Permanent {
+		log.Println("[INFO]: endpoint '/api/v1/delete': permanently deleting", diskPath, "requested by", r.RemoteAddr)
+		return "", os.RemoveAll(diskPath)
+	}
+	log.Println("[INFO]: endpoint '/api/v1/delete': deleting", diskPath, "requested by", r.RemoteAddr)
+	if _, err := s.Trash.Add(diskPath, req.Path); err != nil {
+		if errors.Is(err, ErrTooLargeForTrash) {
+			return "", fmt.Errorf("%w, use Delete permanently instead", err)
+		}
+		return "", err
+	}
+	return "", nil
+}
+
+// copyTree copies from (the resolved form of relFrom) to a new path. Symlinks
+// are copied as the content they point at, and only when they stay in root.
+// A copy that fails part way is removed again.
+func (s *Server) copyTree(r *http.Request, from string, to string, relFrom string) error {
+	created := false
+	err := s.copyEntries(r.Context(), from, to, relFrom, []string{from, to}, &created)
+	if err != nil && created {
+		os.RemoveAll(to)
+	}
+	return err
+}
+
+// copyEntries walks from for copyTree. following holds the folders being
+// copied, so a symlink pointing back up one of them is refused instead of
+// copied forever.
+func (s *Server) copyEntries(ctx context.Context, from string, to string, relFrom string, following []string, created *bool) error {
+	return filepath.WalkDir(from, func(diskPath string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, diskPath)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+		relPath := path.Join(relFrom, filepath.ToSlash(rel))
+		source := diskPath
+		if d.Type()&fs.ModeSymlink != 0 {
+			resolved, err := s.ResolvePath(relPath)
+			if err != nil {
+				return nil
+			}
+			source = resolved
+		}
+		info, err := os.Stat(source)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if d.Type()&fs.ModeSymlink != 0 {
+				for _, dir := range following {
+					if isWithin(source, dir) {
+						return fmt.Errorf("%w: %s", ErrSymlinkLoop, relPath)
+					}
+				}
+				return s.copyEntries(ctx, source, target, relPath, append(following, source), created)
+			}
+			if err := os.Mkdir(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			*created = true
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := copyFile(source, target, info.Mode().Perm()); err != nil {
+			return err
+		}
+		*created = true
+		return nil
+	})
+}
+
+func copyFile(source string, target string, perm fs.FileMode) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(target)
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleActions(w http.ResponseWriter, r *http.Request) {
+	if !s.AllowWrite {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	relPath := r.URL.Query().Get("path")
+	entry, _, err := s.statRequestPath(relPath)
+	if err != nil {
+		WriteResolveError(w, "/actions", err)
+		return
+	}
+	t := parseTemplates("templates/actions.html")
+	if err := t.Execute(w, ActionsTemplateData{Entry: entry}); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyTreeFollowsSymlinkedFolders(t *testing.T) {
+	root, _ := newResolveTree(t)
+	s := &Server{RootFolder: root}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/copy", nil)
+
+	to := filepath.Join(root, "copy")
+	if err := s.copyTree(r, filepath.Join(root, "inlink"), to, "/inlink"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(to, "a.txt")); err != nil || string(data) != "x" {
+		t.Fatalf("copied a.txt = %q, %v", data, err)
+	}
+	if info, err := os.Lstat(to); err != nil || !info.IsDir() {
+		t.Fatalf("copy of a symlinked folder should be a folder, got %v, %v", info, err)
+	}
+}
+
+func TestCopyTreeRemovesFailedCopy(t *testing.T) {
+	root, _ := newResolveTree(t)
+	s := &Server{RootFolder: root}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/copy", nil)
+
+	// A link back up to the folder being copied can't be copied
+	if err := os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "sub", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	to := filepath.Join(root, "copy")
+	if err := s.copyTree(r, filepath.Join(root, "sub"), to, "/sub"); !errors.Is(err, ErrSymlinkLoop) {
+		t.Fatalf("copyTree = %v, want %v", err, ErrSymlinkLoop)
+	}
+	if _, err := os.Lstat(to); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("half written copy left behind: %v", err)
+	}
+}
+
+func TestCopyTreeKeepsExistingDestination(t *testing.T) {
+	root, _ := newResolveTree(t)
+	s := &Server{RootFolder: root}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/copy", nil)
+
+	to := filepath.Join(root, "taken")
+	if err := os.Mkdir(to, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.copyTree(r, filepath.Join(root, "sub"), to, "/sub"); err == nil {
+		t.Fatal("copying over an existing folder should fail")
+	}
+	if _, err := os.Stat(to); err != nil {
+		t.Fatalf("existing destination was removed: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var staticHashes = sync.OnceValue(func() map[string]string {
+	hashes := map[string]string{}
+	err := fs.WalkDir(staticFS, "static", func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := staticFS.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		hashes[strings.TrimPrefix(filePath, "static/")] = hex.EncodeToString(sum[:8])
+		return nil
+	})
+	if err != nil {
+		log.Println("[ERROR]: Hashing static files:", err)
+	}
+	return hashes
+})
+
+// staticURL returns the URL of an embedded static file with its content hash
+// appended, so it can be cached for good and still change between releases.
+func staticURL(name string) string {
+	hash, ok := staticHashes()[name]
+	if !ok {
+		return "/static/" + name
+	}
+	return "/static/" + name + "?v=" + hash
+}
+
+var templateFuncs = template.FuncMap{
+	"static": staticURL,
+}
+
+func parseTemplates(names ...string) *template.Template {
+	return template.Must(template.New(path.Base(names[0])).Funcs(templateFuncs).ParseFS(templatesFS, names...))
+}
+
+// handleStatic serves the embedded static files. Requests carrying the current
+// hash are cacheable forever; anything else has to be revalidated.
+func handleStatic() http.Handler {
+	fileServer := http.FileServer(http.FS(staticFS))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash, ok := staticHashes()[strings.TrimPrefix(r.URL.Path, "/static/")]
+		if ok {
+			w.Header().Set("ETag", `"`+hash+`"`)
+			if r.URL.Query().Get("v") == hash {
+				w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+			} else {
+				w.Header().Set("Cache-Control", "no-cache")
+			}
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// notModified sets the validators for a response and reports whether the
+// request's conditional headers already match them, in which case a 304 has
+// been written. If-None-Match takes precedence over If-Modified-Since.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		if !modTime.Truncate(time.Second).After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	SortName  = "name"
+	SortSize  = "size"
+	SortMtime = "mtime"
+	SortExt   = "ext"
+)
+
+var fileTypeExtensions = map[string][]string{
+	"archives":  {".zip", ".7z", ".rar", ".tar", ".gz", ".tgz", ".bz2", ".xz", ".zst", ".lz4"},
+	"documents": {".pdf", ".txt", ".md", ".doc", ".docx", ".odt", ".rtf", ".epub", ".csv", ".xls", ".xlsx", ".ods", ".ppt", ".pptx", ".odp", ".json", ".xml", ".log"},
+}
+
+var fileTypeMimePrefixes = map[string]string{
+	"images": "image/",
+	"videos": "video/",
+}
+
+type ListChoice struct {
+	Key   string
+	Label string
+}
+
+var sortChoices = []ListChoice{
+	{SortName, "Name"},
+	{SortSize, "Size"},
+	{SortMtime, "Date Modified"},
+	{SortExt, "Type"},
+}
+
+var filterChoices = []ListChoice{
+	{"", "All Files"},
+	{"images", "Images"},
+	{"videos", "Videos"},
+	{"archives", "Archives"},
+	{"documents", "Documents"},
+}
+
+// ListOptions holds every listing option carried in the query string, so that
+// changing one option in the menu keeps the others.
+type ListOptions struct {
+	Sort       string `json:"sort"`
+	Reverse    bool   `json:"reverse"`
+	ShowHidden bool   `json:"showHidden"`
+	Filter     string `json:"filter"`
+}
+
+func parseListOptions(query url.Values) ListOptions {
+	options := ListOptions{
+		Sort:       query.Get("sort"),
+		Reverse:    query.Get("reverse") == "true",
+		ShowHidden: query.Get("hidden") == "true",
+		Filter:     query.Get("type"),
+	}
+	switch options.Sort {
+	case SortName, SortSize, SortMtime, SortExt:
+	default:
+		options.Sort = SortName
+	}
+	if _, ok := fileTypeExtensions[options.Filter]; !ok {
+		if _, ok := fileTypeMimePrefixes[options.Filter]; !ok {
+			options.Filter = ""
+		}
+	}
+	return options
+}
+
+func (o ListOptions) values() url.Values {
+	values := url.Values{}
+	values.Set("hidden", BoolToString(o.ShowHidden))
+	values.Set("reverse", BoolToString(o.Reverse))
+	values.Set("sort", o.Sort)
+	if o.Filter != "" {
+		values.Set("type", o.Filter)
+	}
+	return values
+}
+
+func (o ListOptions) Query() string {
+	return "?" + o.values().Encode()
+}
+
+// QueryWith returns the query string for these options with key set to value.
+// Setting "sort" to the current key flips the order instead.
+func (o ListOptions) QueryWith(key string, value string) string {
+	values := o.values()
+	if key == "sort" && value == o.Sort {
+		values.Set("reverse", BoolToString(!o.Reverse))
+	} else if key == "sort" {
+		values.Set("reverse", "false")
+	}
+	if value == "" {
+		values.Del(key)
+	} else {
+		values.Set(key, value)
+	}
+	return "?" + values.Encode()
+}
+
+func (o ListOptions) SortChoices() []ListChoice {
+	return sortChoices
+}
+
+func (o ListOptions) FilterChoices() []ListChoice {
+	return filterChoices
+}
+
+func (o ListOptions) Matches(entry DirEntry) bool {
+	if o.Filter == "" || entry.IsDir {
+		return true
+	}
+	if prefix, ok := fileTypeMimePrefixes[o.Filter]; ok {
+		return strings.HasPrefix(entry.MimeType, prefix)
+	}
+	ext := strings.ToLower(path.Ext(entry.Name))
+	for _, candidate := range fileTypeExtensions[o.Filter] {
+		if ext == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+func (o ListOptions) SortEntries(entries []DirEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		nameA, nameB := strings.ToLower(a.Name), strings.ToLower(b.Name)
+		var less, equal bool
+		switch o.Sort {
+		case SortSize:
+			less, equal = a.Size < b.Size, a.Size == b.Size
+		case SortMtime:
+			less, equal = a.ModTime.Before(b.ModTime), a.ModTime.Equal(b.ModTime)
+		case SortExt:
+			extA, extB := path.Ext(nameA), path.Ext(nameB)
+			less, equal = extA < extB, extA == extB
+		default:
+			less, equal = nameA < nameB, nameA == nameB
+		}
+		if equal {
+			return nameA < nameB
+		}
+		return less != o.Reverse
+	})
+}
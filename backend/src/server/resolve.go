@@ -0,0 +1,144 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrForbiddenPath = errors.New("path is outside the shared folder")
+
+// ResolvePath maps a request path (relative to RootFolder, already URL decoded)
+// to a path on disk. It refuses anything that would leave RootFolder, either
+// through ".." segments or through symlinks, and when DisableSymlinks is set it
+// refuses to traverse symlinks at all. StateDir is refused too, in case it sits
+// inside RootFolder. The target itself does not need to exist, so it can be used
+// for upload destinations.
+func (s *Server) ResolvePath(requestPath string) (string, error) {
+	if strings.ContainsRune(requestPath, 0) {
+		return "", ErrForbiddenPath
+	}
+	for _, segment := range strings.Split(filepath.ToSlash(requestPath), "/") {
+		if segment == ".." {
+			return "", ErrForbiddenPath
+		}
+	}
+	root, err := filepath.EvalSymlinks(s.RootFolder)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	rel := filepath.Clean("/" + requestPath)
+	joined := filepath.Join(root, rel)
+
+	existing := joined
+	var missing []string
+	var real string
+	for {
+		real, err = filepath.EvalSymlinks(existing)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) || existing == root {
+			return "", err
+		}
+		// A dangling symlink would be followed when the target is created.
+		if _, lstatErr := os.Lstat(existing); lstatErr == nil {
+			return "", ErrForbiddenPath
+		}
+		missing = append([]string{filepath.Base(existing)}, missing...)
+		existing = filepath.Dir(existing)
+	}
+	if !isWithin(root, real) {
+		return "", ErrForbiddenPath
+	}
+	if s.DisableSymlinks && real != existing {
+		return "", ErrForbiddenPath
+	}
+	resolved := filepath.Join(append([]string{real}, missing...)...)
+	if s.inStateDir(resolved) {
+		return "", ErrForbiddenPath
+	}
+	return resolved, nil
+}
+
+// stateDir returns StateDir with symlinks resolved, or "" if there is none.
+func (s *Server) stateDir() string {
+	if s.StateDir == "" {
+		return ""
+	}
+	dir, err := filepath.EvalSymlinks(s.StateDir)
+	if err != nil {
+		dir = s.StateDir
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
+// inStateDir reports whether diskPath is StateDir or something inside it.
+func (s *Server) inStateDir(diskPath string) bool {
+	state := s.stateDir()
+	return state != "" && isWithin(state, diskPath)
+}
+
+func isWithin(root string, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// isAllowedEntry reports whether a listed entry can be shown: symlinks must
+// resolve inside RootFolder, and folders must not be StateDir.
+func (s *Server) isAllowedEntry(entry fs.DirEntry, relPath string) bool {
+	if entry.Type()&fs.ModeSymlink == 0 && !entry.IsDir() {
+		return true
+	}
+	_, err := s.ResolvePath(filepath.Join(relPath, entry.Name()))
+	return err == nil
+}
+
+// WriteResolveError reports a ResolvePath failure, always answering escapes
+// with 403 so handlers behave the same way.
+func WriteResolveError(w http.ResponseWriter, endpoint string, err error) {
+	status := resolveErrorStatus(err)
+	if status != http.StatusNotFound {
+		log.Printf("[ERROR]: endpoint '%s': %v", endpoint, err)
+	}
+	w.WriteHeader(status)
+}
+
+func resolveErrorStatus(err error) int {
+	if errors.Is(err, ErrForbiddenPath) {
+		return http.StatusForbidden
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+// rejectTraversal answers 403 for request paths containing ".." segments
+// before ServeMux gets a chance to clean and redirect them.
+func rejectTraversal(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, segment := range strings.Split(r.URL.Path, "/") {
+			if segment == ".." {
+				WriteResolveError(w, r.URL.Path, ErrForbiddenPath)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
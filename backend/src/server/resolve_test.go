@@ -0,0 +1,165 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newResolveTree lays out a shared folder with symlinks pointing inside it,
+// outside it and nowhere, next to a folder that must never be reachable.
+func newResolveTree(t *testing.T) (root string, outside string) {
+	t.Helper()
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	root = filepath.Join(base, "root")
+	outside = filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := []string{filepath.Join(root, "sub", "a.txt"), filepath.Join(outside, "secret")}
+	for _, file := range files {
+		if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"inlink":      filepath.Join(root, "sub"),
+		"relinlink":   "sub/a.txt",
+		"out":         outside,
+		"relout":      "../outside/secret",
+		"dangling":    filepath.Join(root, "missing"),
+		"danglingout": filepath.Join(base, "nowhere"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, outside
+}
+
+func TestResolvePath(t *testing.T) {
+	root, _ := newResolveTree(t)
+	tests := []struct {
+		name            string
+		path            string
+		disableSymlinks bool
+		want            string
+		wantErr         error
+	}{
+		{name: "root", path: "/", want: root},
+		{name: "empty", path: "", want: root},
+		{name: "file", path: "/sub/a.txt", want: filepath.Join(root, "sub", "a.txt")},
+		{name: "without leading slash", path: "sub/a.txt", want: filepath.Join(root, "sub", "a.txt")},
+		{name: "parent of root", path: "/../outside/secret", wantErr: ErrForbiddenPath},
+		{name: "parent inside path", path: "/sub/../../outside", wantErr: ErrForbiddenPath},
+		{name: "parent staying inside", path: "/sub/../sub/a.txt", wantErr: ErrForbiddenPath},
+		{name: "backslash parent", path: "\\..\\outside", want: filepath.Join(root, "\\..\\outside")},
+		{name: "encoded parent is a plain name", path: "/%2e%2e/outside", want: filepath.Join(root, "%2e%2e", "outside")},
+		{name: "nul byte", path: "/sub/a.txt\x00.png", wantErr: ErrForbiddenPath},
+		{name: "missing file", path: "/sub/new.txt", want: filepath.Join(root, "sub", "new.txt")},
+		{name: "missing folders", path: "/sub/new/deeper/file.txt", want: filepath.Join(root, "sub", "new", "deeper", "file.txt")},
+		{name: "symlink out of root", path: "/out", wantErr: ErrForbiddenPath},
+		{name: "through symlink out of root", path: "/out/secret", wantErr: ErrForbiddenPath},
+		{name: "missing file through symlink out of root", path: "/out/new.txt", wantErr: ErrForbiddenPath},
+		{name: "relative symlink out of root", path: "/relout", wantErr: ErrForbiddenPath},
+		{name: "symlink inside root", path: "/inlink/a.txt", want: filepath.Join(root, "sub", "a.txt")},
+		{name: "relative symlink inside root", path: "/relinlink", want: filepath.Join(root, "sub", "a.txt")},
+		{name: "missing file through symlink inside root", path: "/inlink/new.txt", want: filepath.Join(root, "sub", "new.txt")},
+		{name: "symlink inside root when disabled", path: "/inlink/a.txt", disableSymlinks: true, wantErr: ErrForbiddenPath},
+		{name: "relative symlink inside root when disabled", path: "/relinlink", disableSymlinks: true, wantErr: ErrForbiddenPath},
+		{name: "plain file when disabled", path: "/sub/a.txt", disableSymlinks: true, want: filepath.Join(root, "sub", "a.txt")},
+		{name: "dangling symlink", path: "/dangling", wantErr: ErrForbiddenPath},
+		{name: "through dangling symlink", path: "/dangling/new.txt", wantErr: ErrForbiddenPath},
+		{name: "dangling symlink out of root", path: "/danglingout", wantErr: ErrForbiddenPath},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &Server{RootFolder: root, DisableSymlinks: test.disableSymlinks}
+			got, err := s.ResolvePath(test.path)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("ResolvePath(%q) = %q, %v, want %v", test.path, got, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil || got != test.want {
+				t.Fatalf("ResolvePath(%q) = %q, %v, want %q", test.path, got, err, test.want)
+			}
+		})
+	}
+}
+
+func TestResolvePathSymlinkedRoot(t *testing.T) {
+	root, _ := newResolveTree(t)
+	link := filepath.Join(t.TempDir(), "share")
+	if err := os.Symlink(root, link); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{RootFolder: link, DisableSymlinks: true}
+	got, err := s.ResolvePath("/sub/a.txt")
+	if err != nil || got != filepath.Join(root, "sub", "a.txt") {
+		t.Fatalf("ResolvePath through a symlinked root = %q, %v", got, err)
+	}
+}
+
+func TestRejectTraversal(t *testing.T) {
+	handler := rejectTraversal(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/files/sub/a.txt", http.StatusNoContent},
+		{"/files/../outside", http.StatusForbidden},
+		{"/files/%2e%2e/outside", http.StatusForbidden},
+		{"/files/%2E%2E/outside", http.StatusForbidden},
+		{"/files/sub/..%2f..%2foutside", http.StatusForbidden},
+		{"/files/..%2e/outside", http.StatusNoContent},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, test.target, nil))
+		if recorder.Code != test.want {
+			t.Errorf("%s answered %d, want %d", test.target, recorder.Code, test.want)
+		}
+	}
+}
+
+func TestResolvePathStateDir(t *testing.T) {
+	root, _ := newResolveTree(t)
+	state := filepath.Join(root, "sub", ".state")
+	if err := os.MkdirAll(state, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(state, filepath.Join(root, "statelink")); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{RootFolder: root, StateDir: state}
+	for _, forbidden := range []string{"/sub/.state", "/sub/.state/key.pem", "/sub/.state/trash/new", "/statelink/key.pem"} {
+		if got, err := s.ResolvePath(forbidden); !errors.Is(err, ErrForbiddenPath) {
+			t.Errorf("ResolvePath(%q) = %q, %v, want %v", forbidden, got, err, ErrForbiddenPath)
+		}
+	}
+	if got, err := s.ResolvePath("/sub/.statefile"); err != nil || got != filepath.Join(root, "sub", ".statefile") {
+		t.Errorf("ResolvePath next to StateDir = %q, %v", got, err)
+	}
+	// Moving or deleting a folder holding StateDir would take it along
+	for _, forbidden := range []string{"/sub", "/sub/.state"} {
+		if _, err := s.resolveEntry(forbidden); !errors.Is(err, ErrForbiddenPath) {
+			t.Errorf("resolveEntry(%q) = %v, want %v", forbidden, err, ErrForbiddenPath)
+		}
+	}
+	if _, err := s.resolveEntry("/statelink"); err != nil {
+		t.Errorf("resolveEntry of a symlink to StateDir = %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSearchDepth = 8
+const maxSearchDepth = 32
+const searchBatchSize = 50
+const searchBatchBudget = 300 * time.Millisecond
+
+var errSearchPaused = errors.New("search paused")
+
+type SearchQuery struct {
+	Root       string
+	Pattern    string
+	ShowHidden bool
+	MaxDepth   int
+	After      string
+}
+
+// SearchPage is one batch of results. When Done is false, passing Cursor back
+// as SearchQuery.After resumes the walk where this batch stopped.
+type SearchPage struct {
+	Entries []DirEntry `json:"entries"`
+	Cursor  string     `json:"cursor,omitempty"`
+	Done    bool       `json:"done"`
+}
+
+type SearchTemplateData struct {
+	Page        SearchPage
+	Query       SearchQuery
+	NextURL     string
+	QueryParams string
+	AllowWrite  bool
+}
+
+func (d SearchTemplateData) Row(entry DirEntry) RowData {
+	return RowData{
+		Entry:       entry,
+		QueryParams: d.QueryParams,
+		ShowHidden:  d.Query.ShowHidden,
+		AllowWrite:  d.AllowWrite,
+		Location:    path.Dir(entry.RelPath()),
+	}
+}
+
+func parseSearchQuery(r *http.Request) SearchQuery {
+	query := r.URL.Query()
+	depth, err := strconv.Atoi(query.Get("depth"))
+	if err != nil || depth <= 0 {
+		depth = defaultSearchDepth
+	}
+	if depth > maxSearchDepth {
+		depth = maxSearchDepth
+	}
+	return SearchQuery{
+		Root:       strings.TrimPrefix(query.Get("path"), "/files"),
+		Pattern:    strings.TrimSpace(query.Get("q")),
+		ShowHidden: query.Get("hidden") == "true",
+		MaxDepth:   depth,
+		After:      query.Get("after"),
+	}
+}
+
+func (q SearchQuery) values() url.Values {
+	values := url.Values{}
+	values.Set("q", q.Pattern)
+	values.Set("path", q.Root)
+	values.Set("hidden", BoolToString(q.ShowHidden))
+	values.Set("depth", strconv.Itoa(q.MaxDepth))
+	return values
+}
+
+// matcher treats patterns containing glob characters as a glob against the
+// whole name and anything else as a substring. Both ignore case.
+func (q SearchQuery) matcher() func(string) bool {
+	pattern := strings.ToLower(q.Pattern)
+	if strings.ContainsAny(pattern, "*?[") {
+		if _, err := path.Match(pattern, ""); err == nil {
+			return func(name string) bool {
+				matched, _ := path.Match(pattern, strings.ToLower(name))
+				return matched
+			}
+		}
+	}
+	return func(name string) bool {
+		return strings.Contains(strings.ToLower(name), pattern)
+	}
+}
+
+// walkOrderBefore reports whether a is visited before b by filepath.WalkDir,
+// which walks depth first with entries in lexical order.
+func walkOrderBefore(a string, b string) bool {
+	aParts := strings.Split(a, "/")
+	bParts := strings.Split(b, "/")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		if aParts[i] != bParts[i] {
+			return aParts[i] < bParts[i]
+		}
+	}
+	return len(aParts) < len(bParts)
+}
+
+func (s *Server) searchTree(ctx context.Context, q SearchQuery, limit int, budget time.Duration) (SearchPage, error) {
+	page := SearchPage{Entries: make([]DirEntry, 0)}
+	rootDisk, err := s.ResolvePath(q.Root)
+	if err != nil {
+		return page, err
+	}
+	matches := q.matcher()
+	start := time.Now()
+	err = filepath.WalkDir(rootDisk, func(diskPath string, d fs.DirEntry, walkErr error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if diskPath == rootDisk {
+			return walkErr
+		}
+		if walkErr != nil {
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		relPath, err := filepath.Rel(rootDisk, diskPath)
+		if err != nil {
+			return err
+		}
+		rel := filepath.ToSlash(relPath)
+		descend := d.IsDir() && strings.Count(rel, "/")+1 < q.MaxDepth
+		skip := func() error {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !q.ShowHidden && strings.HasPrefix(d.Name(), ".") {
+			return skip()
+		}
+		if q.After != "" {
+			if rel == q.After || strings.HasPrefix(q.After, rel+"/") {
+				if descend {
+					return nil
+				}
+				return skip()
+			}
+			if walkOrderBefore(rel, q.After) {
+				return skip()
+			}
+		}
+		if !s.isAllowedEntry(d, path.Join(q.Root, path.Dir(rel))) {
+			return skip()
+		}
+		if matches(d.Name()) {
+			if info, err := d.Info(); err == nil {
+				page.Entries = append(page.Entries, newDirEntry(info, path.Join("/files", q.Root, rel), s))
+			}
+		}
+		if len(page.Entries) >= limit || time.Since(start) > budget {
+			page.Cursor = rel
+			return errSearchPaused
+		}
+		if !descend {
+			return skip()
+		}
+		return nil
+	})
+	if errors.Is(err, errSearchPaused) {
+		return page, nil
+	}
+	page.Done = err == nil
+	return page, err
+}
+
+func (s *Server) registerSearch(serveMux *http.ServeMux) {
+	serveMux.HandleFunc("/search", s.handleSearch)
+	serveMux.HandleFunc("/api/v1/search", s.handleAPISearch)
+}
+
+// handleSearch renders one batch of results followed, if the walk is not
+// finished, by an element that loads the next batch as soon as it is swapped
+// in. A batch stops early when the request is cancelled.
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	q := parseSearchQuery(r)
+	if q.Pattern == "" {
+		return
+	}
+	page, err := s.searchTree(r.Context(), q, searchBatchSize, searchBatchBudget)
+	if err != nil {
+		if r.Context().Err() == nil {
+			WriteResolveError(w, "/search", err)
+		}
+		return
+	}
+	data := SearchTemplateData{
+		Page:        page,
+		Query:       q,
+		QueryParams: "?hidden=" + BoolToString(q.ShowHidden),
+		AllowWrite:  s.AllowWrite,
+	}
+	if !page.Done {
+		values := q.values()
+		values.Set("after", page.Cursor)
+		data.NextURL = "/search?" + values.Encode()
+	}
+	t := parseTemplates("templates/search.html", "templates/files.html")
+	if err := t.ExecuteTemplate(w, "search-results", data); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Server) handleAPISearch(w http.ResponseWriter, r *http.Request) {
+	q := parseSearchQuery(r)
+	if q.Pattern == "" {
+		writeAPIError(w, http.StatusBadRequest, "missing param: q")
+		return
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = searchBatchSize
+	}
+	page, err := s.searchTree(r.Context(), q, limit, 5*time.Second)
+	if err != nil {
+		writeAPIResolveError(w, "/api/v1/search", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
@@ -1,19 +1,14 @@
 package server
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"crypto/sha256"
 	"crypto/tls"
 	"deckyfileserver/thumbnail"
 	"embed"
-	"encoding/hex"
-	"html/template"
-	"io"
+	"errors"
+	"mime"
 	"net"
 	"net/http"
-	"net/url"
 	"time"
 
 	"fmt"
@@ -21,15 +16,14 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync/atomic"
 
 	"path/filepath"
-	"sort"
 
-	"github.com/disintegration/imaging"
 	_ "golang.org/x/image/webp"
 )
 
-var thumbGen thumbnail.ThumbnailGenerator
+var thumbGen *thumbnail.ThumbnailGenerator
 
 //go:embed templates/*
 var templatesFS embed.FS
@@ -37,70 +31,53 @@ var templatesFS embed.FS
 //go:embed static/*
 var staticFS embed.FS
 
-//go:embed certs/*
-var certsFS embed.FS
-
 type DirEntry struct {
-	Name      string
-	Size      FileSize
-	IsDir     bool
-	Path      string
-	Thumbnail bool
+	Name      string    `json:"name"`
+	Size      FileSize  `json:"size"`
+	IsDir     bool      `json:"isDir"`
+	Path      string    `json:"path"`
+	Thumbnail bool      `json:"thumbnail"`
+	Sprite    bool      `json:"sprite"`
+	ModTime   time.Time `json:"mtime"`
+	Mode      string    `json:"mode"`
+	MimeType  string    `json:"mimeType"`
 }
 
 type FilePageData struct {
-	Entries      []DirEntry
-	Path         string
-	ParentPath   string
-	IsHome       bool
-	Reverse      bool
-	ShowHidden   bool
-	QueryParams  string
-	AllowUploads bool
+	Entries    []DirEntry `json:"entries"`
+	Path       string     `json:"path"`
+	ParentPath string     `json:"parentPath"`
+	IsHome     bool       `json:"-"`
+	ListOptions
+	QueryParams  string `json:"-"`
+	AllowUploads bool   `json:"allowUploads"`
+	AllowWrite   bool   `json:"allowWrite"`
 }
 
-type UploadTemplateData struct {
-	Path string
+type RowData struct {
+	Entry       DirEntry
+	QueryParams string
+	ShowHidden  bool
+	AllowWrite  bool
+	Location    string
 }
 
-func (f FilePageData) ReverseParamText() string {
-	str := "?hidden="
-	if f.ShowHidden {
-		str += "true"
-	} else {
-		str += "false"
+func (f FilePageData) Row(entry DirEntry) RowData {
+	return RowData{
+		Entry:       entry,
+		QueryParams: f.QueryParams,
+		ShowHidden:  f.ShowHidden,
+		AllowWrite:  f.AllowWrite,
 	}
-	str += "&reverse="
-	if f.Reverse {
-		str += "false"
-	} else {
-		str += "true"
-	}
-	return str
 }
 
-func (f FilePageData) HiddenParamText() string {
-	str := "?hidden="
-	if f.ShowHidden {
-		str += "false"
-	} else {
-		str += "true"
-	}
-	str += "&reverse="
-	if f.Reverse {
-		str += "true"
-	} else {
-		str += "false"
-	}
-	return str
+func (f FilePageData) RelPath() string {
+	return strings.TrimPrefix(f.Path, "/files")
 }
 
-type MenuItemsData struct {
-	Path              string
-	Reverse           bool
-	ShowHidden        bool
-	HiddenParamsText  string
-	ReverseParamsText string
+type UploadTemplateData struct {
+	Path      string
+	ChunkSize int64
 }
 
 func BoolToString(b bool) string {
@@ -129,89 +106,170 @@ func (bytes FileSize) FormatSizeUnits() string {
 	}
 }
 
-func getDir(dirPath string, requestPath string, reverseSort bool, showHidden bool, server *Server) (FilePageData, error) {
+func newDirEntry(info os.FileInfo, requestPath string, server *Server) DirEntry {
+	mimeType := "inode/directory"
+	if !info.IsDir() {
+		mimeType = mime.TypeByExtension(path.Ext(info.Name()))
+		if mimeType == "" {
+			mimeType = "application/octet-stream"
+		}
+	}
+	return DirEntry{
+		Name:      info.Name(),
+		IsDir:     info.IsDir(),
+		Size:      FileSize(info.Size()),
+		Path:      requestPath,
+		Thumbnail: !server.DisableThumbnails && !info.IsDir() && thumbGen.IsCompatibleType(info.Name()),
+		Sprite:    !server.DisableThumbnails && !info.IsDir() && thumbGen.HasSprite(info.Name()),
+		ModTime:   info.ModTime(),
+		Mode:      info.Mode().String(),
+		MimeType:  mimeType,
+	}
+}
+
+func getDir(dirPath string, requestPath string, options ListOptions, server *Server) (FilePageData, error) {
 	dirEntry, _ := os.ReadDir(dirPath)
 	parentPath := filepath.Dir(requestPath)
 	dirs := make([]DirEntry, 0)
 	for _, entry := range dirEntry {
 		info, _ := entry.Info()
-		if !showHidden && strings.HasPrefix(info.Name(), ".") {
+		if !options.ShowHidden && strings.HasPrefix(info.Name(), ".") {
 			continue
 		}
-		dirs = append(dirs, DirEntry{
-			Name:      entry.Name(),
-			IsDir:     entry.IsDir(),
-			Size:      FileSize(info.Size()),
-			Path:      path.Join(requestPath, entry.Name()),
-			Thumbnail: !server.DisableThumbnails && thumbGen.IsCompatibleType(entry.Name()),
-		})
-	}
-	sort.Slice(dirs[:], func(i, j int) bool {
-		if dirs[i].IsDir != dirs[j].IsDir {
-			return dirs[i].IsDir
+		if !server.isAllowedEntry(entry, strings.TrimPrefix(requestPath, "/files")) {
+			continue
 		}
-		return strings.ToLower(dirs[i].Name) < strings.ToLower(dirs[j].Name) != reverseSort
-	})
-	queryParams := fmt.Sprintf("?hidden=%s&reverse=%s", BoolToString(showHidden), BoolToString(reverseSort))
+		dirEntry := newDirEntry(info, path.Join(requestPath, entry.Name()), server)
+		if !options.Matches(dirEntry) {
+			continue
+		}
+		dirs = append(dirs, dirEntry)
+	}
+	options.SortEntries(dirs)
 	dirData := FilePageData{
 		Entries:      dirs,
 		Path:         requestPath,
 		ParentPath:   parentPath,
 		IsHome:       requestPath == "/files/",
-		Reverse:      reverseSort,
-		ShowHidden:   showHidden,
-		QueryParams:  queryParams,
+		ListOptions:  options,
+		QueryParams:  options.Query(),
 		AllowUploads: server.Uploads,
+		AllowWrite:   server.AllowWrite,
 	}
 	return dirData, nil
 }
 
 type Server struct {
-	Uploads           bool
-	DisableThumbnails bool
-	Port              int
-	Timeout           int
-	RootFolder        string
-	Server            http.Server
-	ShutdownChan      chan struct{}
-	UploadJobs        map[string]string
+	Uploads              bool
+	AllowWrite           bool
+	DisableThumbnails    bool
+	Port                 int
+	Timeout              int
+	RootFolder           string
+	DisableSymlinks      bool
+	StateDir             string
+	CertFile             string
+	KeyFile              string
+	CertFingerprint      string
+	TrashRetention       time.Duration
+	TrashMaxBytes        int64
+	UploadExpiry         time.Duration
+	UploadRequestBytes   int64
+	ThumbnailCacheBytes  int64
+	ThumbnailCacheAge    time.Duration
+	ThumbnailMemoryBytes int64
+	ThumbnailWorkers     int
+	ShowGPS              bool
+	SpriteFrames         int
+	BoxArtDir            string
+	VideoClipSeconds     float64
+	Trash                *Trash
+	Server               http.Server
+	ShutdownChan         chan struct{}
+	activityChan         chan struct{}
+	deadline             atomic.Int64
+	uploadManager        *UploadManager
+	Sessions             *SessionStore
 }
 
 func (s *Server) setupHTTPServer() {
-	thumbGen = thumbnail.ThumbnailGenerator{
-		Cache: thumbnail.Cache{
-			Images: map[string]*thumbnail.CacheImageJob{},
-			Chans:  map[string]chan *thumbnail.CacheImageJob{},
-		},
+	thumbGen = thumbnail.NewThumbnailGenerator(thumbnail.NewCache(s.ThumbnailMemoryBytes))
+	thumbGen.SetWorkerCount(s.ThumbnailWorkers)
+	if s.SpriteFrames > 0 {
+		thumbGen.Sprites = thumbnail.NewSpriteLayout(s.SpriteFrames)
+	}
+	if s.VideoClipSeconds > 0 {
+		thumbGen.Providers.RegisterMimeType(thumbnail.NewVideoProvider(s.VideoClipSeconds), "video/*")
+	}
+	if s.BoxArtDir != "" {
+		thumbGen.Providers.RegisterExtension(thumbnail.NewBoxArtProvider(s.BoxArtDir), thumbnail.ROMExtensions...)
+	}
+	if !s.DisableThumbnails {
+		diskCache, diskErr := thumbnail.NewDiskCache(filepath.Join(s.StateDir, "thumbnails"), s.ThumbnailCacheBytes, s.ThumbnailCacheAge)
+		if diskErr != nil {
+			log.Println("[ERROR]: Cannot create thumbnail cache, thumbnails will not be kept between runs:", diskErr)
+		} else {
+			thumbGen.Disk = diskCache
+			go diskCache.RunEvictor(time.Hour)
+		}
+	}
+
+	sessions, sessionErr := NewSessionStore(time.Duration(s.Timeout) * time.Second)
+	if sessionErr != nil {
+		log.Fatalf("[ERROR]: Cannot create session store: %v", sessionErr)
+	}
+	s.Sessions = sessions
+
+	if s.AllowWrite {
+		trash, trashErr := NewTrash(filepath.Join(s.StateDir, "trash"), s.TrashRetention, s.TrashMaxBytes)
+		if trashErr != nil {
+			log.Fatalf("[ERROR]: Cannot create trash folder: %v", trashErr)
+		}
+		s.Trash = trash
+		go s.Trash.RunPurger(time.Hour)
+	}
+
+	if s.Uploads {
+		uploadManager, uploadsErr := NewUploadManager(filepath.Join(s.StateDir, "uploads"), s.UploadExpiry)
+		if uploadsErr != nil {
+			log.Fatalf("[ERROR]: Cannot create uploads folder: %v", uploadsErr)
+		}
+		s.uploadManager = uploadManager
+		go s.uploadManager.RunExpiry(time.Hour)
 	}
-	thumbGen.SetWorkerCount(4)
 
 	serveMux := http.NewServeMux()
 
-	connStateCh := make(chan struct{})
+	s.activityChan = make(chan struct{})
 	s.ShutdownChan = make(chan struct{})
 
-	cert, _ := certsFS.ReadFile("certs/cert.pem")
-	certKey, _ := certsFS.ReadFile("certs/key.pem")
-	certPair, _ := tls.X509KeyPair(cert, certKey)
+	certPair, certErr := s.loadCertificate()
+	if certErr != nil {
+		log.Fatalf("[ERROR]: Cannot load TLS certificate: %v", certErr)
+	}
+	s.CertFingerprint = CertificateFingerprint(certPair)
+	fmt.Printf("FINGERPRINT: %s\n", s.CertFingerprint)
+	log.Println("[INFO]: Certificate SHA-256 fingerprint:", s.CertFingerprint)
 	s.Server = http.Server{
 		Addr: fmt.Sprintf(":%v", s.Port),
 		TLSConfig: &tls.Config{
 			Certificates: []tls.Certificate{certPair},
 		},
-		Handler: serveMux, ConnState: func(c net.Conn, cs http.ConnState) {
+		Handler: rejectTraversal(s.requireSession(serveMux)), ConnState: func(c net.Conn, cs http.ConnState) {
 			if cs == http.StateActive {
-				connStateCh <- struct{}{}
+				s.activityChan <- struct{}{}
 			}
 		}}
 
 	go func() {
 		timer := time.NewTimer(time.Duration(s.Timeout) * time.Second)
+		s.deadline.Store(time.Now().Add(time.Duration(s.Timeout) * time.Second).UnixNano())
 		for {
 			select {
-			case <-connStateCh:
+			case <-s.activityChan:
 				timer.Stop()
 				timer.Reset(time.Duration(s.Timeout) * time.Second)
+				s.deadline.Store(time.Now().Add(time.Duration(s.Timeout) * time.Second).UnixNano())
 			case <-timer.C:
 				log.Println("Performing shutdown")
 				s.Cleanup()
@@ -230,27 +288,35 @@ func (s *Server) setupHTTPServer() {
 		}
 	})
 
+	serveMux.HandleFunc("/pair", s.handlePair)
+	serveMux.HandleFunc("/logout", s.handleLogout)
+	serveMux.HandleFunc("/connect", s.handleConnect)
+
 	serveMux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
-		reverse := r.URL.Query().Get("reverse") == "true"
-		showHidden := r.URL.Query().Get("hidden") == "true"
+		options := parseListOptions(r.URL.Query())
 		trimmedPath := strings.TrimPrefix(r.URL.Path, "/files")
-		joinedPath := path.Join(s.RootFolder, trimmedPath)
+		joinedPath, resolveErr := s.ResolvePath(trimmedPath)
+		if resolveErr != nil {
+			WriteResolveError(w, "/files/", resolveErr)
+			return
+		}
 		stat, err := os.Stat(joinedPath)
 		if err != nil {
 			log.Println("[ERROR]: endpoint '/':", err.Error())
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 		if stat.IsDir() {
-			dirData, _ := getDir(joinedPath, r.URL.Path, reverse, showHidden, s)
+			dirData, _ := getDir(joinedPath, r.URL.Path, options, s)
 			var paths []string
 			for _, dd := range dirData.Entries {
 				paths = append(paths, path.Join(joinedPath, dd.Name))
 			}
 			if !s.DisableThumbnails {
-				go thumbGen.StartBatchJob(paths)
+				thumbGen.StartBatchJob(paths)
 			}
 			if r.Header.Get("HX-Request") == "true" {
-				t := template.Must(template.ParseFS(templatesFS, "templates/files.html"))
+				t := parseTemplates("templates/files.html")
 				err := t.ExecuteTemplate(w, "content", dirData)
 				if err != nil {
 					log.Println(err)
@@ -260,7 +326,7 @@ func (s *Server) setupHTTPServer() {
 					log.Println(errMenu)
 				}
 			} else {
-				t := template.Must(template.ParseFS(templatesFS, "templates/index.html", "templates/files.html"))
+				t := parseTemplates("templates/index.html", "templates/files.html")
 				err := t.Execute(w, dirData)
 				if err != nil {
 					log.Println(err)
@@ -273,23 +339,48 @@ func (s *Server) setupHTTPServer() {
 		}
 	})
 
-	serveMux.Handle("/static/", http.FileServer(http.FS(staticFS)))
+	serveMux.HandleFunc("/archive/files/", s.handleArchive)
+	s.registerAPI(serveMux)
+	s.registerFileOps(serveMux)
+	s.registerTrash(serveMux)
+	s.registerSearch(serveMux)
+	s.registerDetails(serveMux)
+	s.registerTus(serveMux)
+	serveMux.Handle("/dav/", s.davHandler())
+
+	serveMux.Handle("/static/", handleStatic())
 	serveMux.HandleFunc("/preview/", func(w http.ResponseWriter, r *http.Request) {
-		escaped, escapeErr := url.PathUnescape(r.RequestURI)
-		if escapeErr != nil {
-			log.Println("[ERROR]: endpoint '/preview/':", escapeErr.Error())
+		filePath, resolveErr := s.ResolvePath(strings.TrimPrefix(r.URL.Path, "/preview/files"))
+		if resolveErr != nil {
+			WriteResolveError(w, "/preview/", resolveErr)
+			return
 		}
-		filePath := strings.TrimPrefix(escaped, "/preview/files")
-		filePath = path.Join(s.RootFolder, filePath)
-		thumb, err := thumbGen.GetThumbnail(filePath, r.Context())
-		if err != nil {
-			log.Println("[ERROR]: /Preview ThumbGen:", err)
+		info, statErr := os.Stat(filePath)
+		if statErr != nil {
+			WriteResolveError(w, "/preview/", statErr)
+			return
+		}
+		opts := thumbnail.ParseOptions(r.URL.Query(), r.Header.Get("Accept"))
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Set("Vary", "Accept")
+		if notModified(w, r, `"`+thumbnail.Version(info)+"-"+opts.Key()+`"`, info.ModTime()) {
+			return
+		}
+		thumb, err := thumbGen.GetThumbnail(filePath, opts, r.Context())
+		if errors.Is(err, thumbnail.ErrNoThumbnail) {
+			w.WriteHeader(http.StatusNotFound)
+			return
 		}
-		if thumb != nil {
-			encodeErr := imaging.Encode(w, thumb, imaging.JPEG)
-			if encodeErr != nil {
-				log.Println("[ERROR]: error", encodeErr)
+		if err != nil {
+			if r.Context().Err() == nil {
+				log.Println("[ERROR]: /Preview ThumbGen:", err)
+				w.WriteHeader(http.StatusInternalServerError)
 			}
+			return
+		}
+		w.Header().Set("Content-Type", thumbnail.ContentType(thumb))
+		if _, writeErr := w.Write(thumb); writeErr != nil {
+			log.Println("[ERROR]: error", writeErr)
 		}
 	})
 
@@ -300,228 +391,77 @@ func (s *Server) setupHTTPServer() {
 		}
 		if r.Method == "GET" {
 			data := UploadTemplateData{
-				Path: strings.TrimPrefix(r.URL.Query().Get("path"), "/files"),
+				Path:      strings.TrimPrefix(r.URL.Query().Get("path"), "/files"),
+				ChunkSize: 1 << 20,
 			}
-			t := template.Must(template.ParseFS(templatesFS, "templates/upload.html"))
+			if s.UploadRequestBytes > 0 && s.UploadRequestBytes < data.ChunkSize {
+				data.ChunkSize = s.UploadRequestBytes
+			}
+			t := parseTemplates("templates/upload.html")
 			err := t.Execute(w, data)
 			if err != nil {
 				log.Println(err)
 				return
 			}
 			return
-		} else if r.Method == "POST" {
-			var existsErr error
-			log.Println("[INFO]: endpoint '/upload':", r.URL.Path)
-			r.Body = http.MaxBytesReader(w, r.Body, 1<<20) //1MB
-
-			start, existsErr := GetHeader(w, r, "Upload-Offset")
-			if existsErr != nil {
-				return
-			}
-			uploadIncomplete, existsErr := GetHeader(w, r, "Upload-Incomplete")
-			if existsErr != nil {
-				return
-			}
-			checksum, existsErr := GetHeader(w, r, "X-File-Checksum")
-			if existsErr != nil {
-				return
-			}
-			fileName, existsErr := GetQueryParam(w, r, "filename")
-			if existsErr != nil {
-				return
-			}
-			if result, decodeErr := url.QueryUnescape(fileName); decodeErr != nil {
-				log.Println("[ERROR]: endpoint '/upload':", decodeErr)
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte("Invalid file name"))
-				return
-			} else {
-				fileName = result
-			}
-			directoryPath, existsErr := GetQueryParam(w, r, "path")
-			if existsErr != nil {
-				return
-			}
-			cleanPath := path.Clean(path.Join(s.RootFolder, directoryPath))
-			tmpFilePath := path.Join(cleanPath, checksum)
-
-			var tmpFile *os.File
-			if start == "0" {
-				if createdFile, err := CreateFile(w, cleanPath, checksum); err != nil {
-					return
-				} else {
-					tmpFile = createdFile
-				}
-				s.UploadJobs[checksum] = tmpFilePath
-			} else {
-				openFile, err := os.OpenFile(tmpFilePath, os.O_APPEND|os.O_WRONLY, 0644)
-				if err != nil {
-					log.Println("[ERROR]: endpoint '/upload':", err)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-				tmpFile = openFile
-			}
-			defer tmpFile.Close()
-
-			writeErr := WriteBufferToFile(w, tmpFile, r.Body)
-			if writeErr != nil {
-				return
-			}
-
-			if uploadIncomplete == "false" {
-				log.Println("file has been uploaded")
-				log.Println("[INFO]: file has been uploaded")
-				log.Println("[INFO]: Moving file to:" + filepath.Join(cleanPath, fileName))
-
-				tmpFile.Close()
-				checksumErr := CheckAgainstChecksum(w, tmpFilePath, checksum)
-				if checksumErr != nil {
-					return
-				}
-
-				moveErr := os.Rename(tmpFilePath, filepath.Join(cleanPath, fileName))
-				if moveErr != nil {
-					log.Println("[ERROR]: endpoint '/upload':", moveErr)
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-				delete(s.UploadJobs, checksum)
-			}
-			w.WriteHeader(http.StatusOK)
-
 		} else {
 			w.WriteHeader(http.StatusNotFound)
 		}
 	})
-
-	serveMux.HandleFunc("/cancel_upload", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("[INFO]: endpoint '/cancel_upload':", r.URL.Path)
-		if !s.Uploads {
-			w.WriteHeader(http.StatusMethodNotAllowed)
-			return
-		}
-
-		filehash := r.URL.Query().Get("filehash")
-		existsErr := CheckExists(w, filehash, "filehash")
-		if existsErr != nil {
-			return
-		}
-		if path := s.UploadJobs[filehash]; path != "" {
-			log.Println("[INFO]: endpoint '/cancel_upload': removing ", path)
-			err := os.Remove(path)
-			if err != nil {
-				log.Println("[ERROR]: endpoint '/cancel_upload':", err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			delete(s.UploadJobs, filehash)
-		}
-
-	})
 }
 
+// Cleanup removes unfinished uploads that have expired. The rest are kept so
+// they can be resumed the next time the server runs.
 func (s *Server) Cleanup() {
-	for key, value := range s.UploadJobs {
-		log.Println(key, value)
-		_, statErr := os.Stat(value)
-		log.Println("Error", statErr)
-		if statErr == nil {
-			log.Println("Removing incomplete file: ", value)
-			rmErr := os.Remove(value)
-			if rmErr != nil {
-				log.Println("[ERROR]: Cleanup job: ", rmErr)
-				continue 
-			}
-			delete(s.UploadJobs, key)
-		}
-	}
-}
-
-func (s *Server) Start() {
-	s.setupHTTPServer()
-	if err := s.Server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
-		log.Fatalf("HTTP server ListenAndServe: %v", err)
+	if s.uploadManager != nil {
+		s.uploadManager.ExpireAbandoned()
 	}
-	<-s.ShutdownChan
 }
 
-func GetHeader(w http.ResponseWriter, r *http.Request, key string) (string, error) {
-	value := r.Header.Get(key)
-	err := CheckExists(w, value, key)
-	if err != nil {
-		return "", err
+func (s *Server) TimeoutRemaining() time.Duration {
+	remaining := time.Until(time.Unix(0, s.deadline.Load()))
+	if remaining < 0 {
+		return 0
 	}
-	return value, nil
+	return remaining
 }
 
-func GetQueryParam(w http.ResponseWriter, r *http.Request, key string) (string, error) {
-	value := r.URL.Query().Get(key)
-	err := CheckExists(w, value, key)
-	if err != nil {
-		return "", err
+// KeepAlive resets the inactivity timer for work that outlives a request
+// becoming active, such as long running downloads.
+func (s *Server) KeepAlive() {
+	select {
+	case s.activityChan <- struct{}{}:
+	default:
 	}
-	return value, nil
 }
 
-func CheckExists(w http.ResponseWriter, value string, valueName string) error {
-	if value == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		_, err := w.Write([]byte("missing param: " + valueName))
-		if err != nil {
-			log.Println("[ERROR]: endpoint '/upload':", err)
-			return err
-		}
-		return fmt.Errorf("missing param: %s", valueName)
+// keepAliveWhileRunning calls KeepAlive periodically until the returned
+// function is called.
+func (s *Server) keepAliveWhileRunning() func() {
+	interval := time.Duration(s.Timeout) * time.Second / 2
+	if interval <= 0 || interval > 10*time.Second {
+		interval = 10 * time.Second
 	}
-	return nil
-}
-
-func CreateFile(w http.ResponseWriter, filePath string, fileName string) (*os.File, error) {
-	_, statErr := os.Stat(filePath)
-	if os.IsNotExist(statErr) {
-		w.WriteHeader(http.StatusBadRequest)
-		_, writeErr := w.Write([]byte(fmt.Sprintf("directory path %s does not exist", filePath)))
-		if writeErr != nil {
-			log.Println("[ERROR]: endpoint '/upload':", writeErr)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.KeepAlive()
+			case <-done:
+				return
+			}
 		}
-	}
-	fileCreate, err := os.Create(path.Join(filePath, fileName))
-	if err != nil {
-		log.Println("[ERROR]: endpoint '/upload_file/':", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return &os.File{}, err
-	}
-	return fileCreate, nil
-}
-
-func WriteBufferToFile(w http.ResponseWriter, file *os.File, body io.Reader) error {
-	buf := bufio.NewReader(body)
-	b := new(bytes.Buffer)
-	_, copyErr := io.Copy(b, buf)
-	if copyErr != nil {
-		log.Println("[ERROR]: endpoint '/upload':", copyErr)
-		w.WriteHeader(http.StatusInternalServerError)
-		return copyErr
-	}
-	_, writeErr := file.Write(b.Bytes())
-	if writeErr != nil {
-		log.Println("[ERROR]: endpoint '/upload_file/':", writeErr)
-		w.WriteHeader(http.StatusInternalServerError)
-		return writeErr
-	}
-	return nil
+	}()
+	return func() { close(done) }
 }
 
-func CheckAgainstChecksum(w http.ResponseWriter, filePath string, checksum string) error {
-	hash := sha256.New()
-	file, _ := os.OpenFile(filePath, os.O_RDONLY, 0644)
-	io.Copy(hash, file)
-	transferredChecksum := hash.Sum(nil)
-	if checksum != hex.EncodeToString(transferredChecksum) {
-		log.Println("[ERROR]: endpoint '/upload':", "Checksum mismatch", checksum, hex.EncodeToString(transferredChecksum))
-		w.WriteHeader(http.StatusInternalServerError)
-		return fmt.Errorf("Checksum mismatch")
+func (s *Server) Start() {
+	s.setupHTTPServer()
+	if err := s.Server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+		log.Fatalf("HTTP server ListenAndServe: %v", err)
 	}
-	return nil
+	<-s.ShutdownChan
 }
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const certValidity = 825 * 24 * time.Hour
+const certRenewBefore = 30 * 24 * time.Hour
+
+func (s *Server) loadCertificate() (tls.Certificate, error) {
+	if s.CertFile != "" || s.KeyFile != "" {
+		return tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+	}
+	certPath := filepath.Join(s.StateDir, "cert.pem")
+	keyPath := filepath.Join(s.StateDir, "key.pem")
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil && certStillValid(cert) {
+		return cert, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("[ERROR]: Stored certificate is unusable, generating a new one:", err)
+	}
+	log.Println("[INFO]: Generating self-signed certificate in", s.StateDir)
+	if err := GenerateCertificate(certPath, keyPath); err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.LoadX509KeyPair(certPath, keyPath)
+}
+
+func certStillValid(cert tls.Certificate) bool {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false
+	}
+	if time.Now().Add(certRenewBefore).After(leaf.NotAfter) {
+		return false
+	}
+	// The Deck's address changes between networks, and a certificate that
+	// doesn't cover the one shown on the panel would be refused by clients
+	hosts, ips := localNames()
+	for _, h := range hosts {
+		if leaf.VerifyHostname(h) != nil {
+			log.Println("[INFO]: Certificate does not cover current host name", h)
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if leaf.VerifyHostname(ip.String()) != nil {
+			log.Println("[INFO]: Certificate does not cover current address", ip)
+			return false
+		}
+	}
+	return true
+}
+
+func localNames() ([]string, []net.IP) {
+	hosts := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hosts = append(hosts, hostname)
+		if !strings.Contains(hostname, ".") {
+			hosts = append(hosts, hostname+".local")
+		}
+	}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Println("[ERROR]: Cannot list network addresses:", err)
+		return hosts, ips
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ips = append(ips, ipNet.IP)
+	}
+	return hosts, ips
+}
+
+func GenerateCertificate(certPath string, keyPath string) error {
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hosts, ips := localNames()
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"DeckyFileServer"}, CommonName: "DeckyFileServer"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(certValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              hosts,
+		IPAddresses:           ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writePEM(keyPath, "EC PRIVATE KEY", keyDer, 0600); err != nil {
+		return err
+	}
+	return writePEM(certPath, "CERTIFICATE", der, 0644)
+}
+
+func writePEM(filePath string, blockType string, der []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return pem.Encode(file, &pem.Block{Type: blockType, Bytes: der})
+}
+
+func CertificateFingerprint(cert tls.Certificate) string {
+	sum := sha256.Sum256(cert.Certificate[0])
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrTrashEntryNotFound = errors.New("trash entry not found")
+var ErrTooLargeForTrash = errors.New("larger than the trash size limit")
+
+// Trash keeps deleted entries in <dir>/files/<id> with their metadata in
+// <dir>/info/<id>.json, so they can be listed and restored later.
+type Trash struct {
+	Dir       string
+	Retention time.Duration
+	MaxBytes  int64
+	mu        sync.Mutex
+}
+
+type TrashEntry struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	OriginalPath string    `json:"originalPath"`
+	DeletedAt    time.Time `json:"deletedAt"`
+	Size         FileSize  `json:"size"`
+	IsDir        bool      `json:"isDir"`
+}
+
+type TrashTemplateData struct {
+	Entries []TrashEntry
+}
+
+func NewTrash(dir string, retention time.Duration, maxBytes int64) (*Trash, error) {
+	for _, sub := range []string{"files", "info"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &Trash{Dir: dir, Retention: retention, MaxBytes: maxBytes}, nil
+}
+
+func (t *Trash) filesPath(id string) string {
+	return filepath.Join(t.Dir, "files", id)
+}
+
+func (t *Trash) infoPath(id string) string {
+	return filepath.Join(t.Dir, "info", id+".json")
+}
+
+// Add moves diskPath into the trash. relPath is where it lived relative to
+// RootFolder and is where Restore puts it back.
+func (t *Trash) Add(diskPath string, relPath string) (TrashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, err := os.Lstat(diskPath)
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	idBytes := make([]byte, 4)
+	if _, err := rand.Read(idBytes); err != nil {
+		return TrashEntry{}, err
+	}
+	entry := TrashEntry{
+		ID:           fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(idBytes)),
+		Name:         info.Name(),
+		OriginalPath: path.Clean("/" + relPath),
+		DeletedAt:    time.Now(),
+		Size:         FileSize(treeSize(diskPath)),
+		IsDir:        info.IsDir(),
+	}
+	if t.MaxBytes > 0 && int64(entry.Size) > t.MaxBytes {
+		return TrashEntry{}, fmt.Errorf("%s: %w", relPath, ErrTooLargeForTrash)
+	}
+	if err := writeTrashInfo(t.infoPath(entry.ID), entry); err != nil {
+		return TrashEntry{}, err
+	}
+	if err := moveEntry(diskPath, t.filesPath(entry.ID)); err != nil {
+		os.Remove(t.infoPath(entry.ID))
+		return TrashEntry{}, err
+	}
+	return entry, nil
+}
+
+func writeTrashInfo(infoPath string, entry TrashEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(infoPath, data, 0600)
+}
+
+func (t *Trash) get(id string) (TrashEntry, error) {
+	var entry TrashEntry
+	if id == "" || strings.ContainsAny(id, "/\\.") {
+		return entry, ErrTrashEntryNotFound
+	}
+	data, err := os.ReadFile(t.infoPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return entry, ErrTrashEntryNotFound
+	}
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(data, &entry)
+	return entry, err
+}
+
+func (t *Trash) Get(id string) (TrashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.get(id)
+}
+
+func (t *Trash) list() ([]TrashEntry, error) {
+	infos, err := os.ReadDir(filepath.Join(t.Dir, "info"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]TrashEntry, 0, len(infos))
+	for _, info := range infos {
+		id, found := strings.CutSuffix(info.Name(), ".json")
+		if !found {
+			continue
+		}
+		entry, err := t.get(id)
+		if err != nil {
+			log.Println("[ERROR]: Trash: unreadable entry", info.Name(), err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	return entries, nil
+}
+
+func (t *Trash) List() ([]TrashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.list()
+}
+
+// Restore moves the entry back to target, which the caller must have resolved
+// inside RootFolder. Missing parent folders are recreated.
+func (t *Trash) Restore(id string, target string) (TrashEntry, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, err := t.get(id)
+	if err != nil {
+		return entry, err
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return entry, ErrDestinationExists
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return entry, err
+	}
+	if err := moveEntry(t.filesPath(id), target); err != nil {
+		return entry, err
+	}
+	return entry, os.Remove(t.infoPath(id))
+}
+
+func (t *Trash) Purge(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, err := t.get(id); err != nil {
+		return err
+	}
+	return t.purge(id)
+}
+
+func (t *Trash) purge(id string) error {
+	if err := os.RemoveAll(t.filesPath(id)); err != nil {
+		return err
+	}
+	return os.Remove(t.infoPath(id))
+}
+
+// PurgeExpired removes entries older than Retention, then the oldest entries
+// until the trash fits in MaxBytes. A zero value disables either limit.
+func (t *Trash) PurgeExpired() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries, err := t.list()
+	if err != nil {
+		log.Println("[ERROR]: Trash purge:", err)
+		return
+	}
+	var total int64
+	for _, entry := range entries {
+		total += int64(entry.Size)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		expired := t.Retention > 0 && time.Since(entry.DeletedAt) > t.Retention
+		oversize := t.MaxBytes > 0 && total > t.MaxBytes
+		if !expired && !oversize {
+			continue
+		}
+		log.Println("[INFO]: Trash purge: removing", entry.OriginalPath, "deleted at", entry.DeletedAt.Format(time.RFC3339))
+		if err := t.purge(entry.ID); err != nil {
+			log.Println("[ERROR]: Trash purge:", err)
+			continue
+		}
+		total -= int64(entry.Size)
+	}
+}
+
+func (t *Trash) RunPurger(interval time.Duration) {
+	t.PurgeExpired()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.PurgeExpired()
+	}
+}
+
+func treeSize(diskPath string) int64 {
+	var size int64
+	filepath.WalkDir(diskPath, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, infoErr := d.Info(); infoErr == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// moveEntry renames from to to, falling back to copy and delete when they are
+// on different filesystems (eg. an SD card and the internal drive). Symlinks
+// are recreated rather than followed. A copy that fails part way is removed
+// again, unless to was already there.
+func moveEntry(from string, to string) error {
+	err := os.Rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	created := false
+	err = filepath.WalkDir(from, func(diskPath string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel, err := filepath.Rel(from, diskPath)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(diskPath)
+			if err != nil {
+				return err
+			}
+			err = os.Symlink(link, target)
+			created = created || err == nil
+			return err
+		case d.IsDir():
+			err := os.Mkdir(target, info.Mode().Perm())
+			created = created || err == nil
+			return err
+		case info.Mode().IsRegular():
+			if err := copyFile(diskPath, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			created = true
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		return nil
+	})
+	if err != nil {
+		if created {
+			os.RemoveAll(to)
+		}
+		return err
+	}
+	return os.RemoveAll(from)
+}
+
+func (s *Server) registerTrash(serveMux *http.ServeMux) {
+	serveMux.HandleFunc("/trash", s.handleTrashPage)
+	serveMux.HandleFunc("/api/v1/trash", s.handleAPITrash)
+	serveMux.HandleFunc("/api/v1/trash/restore", s.handleTrashRestore)
+	serveMux.HandleFunc("/api/v1/trash/purge", s.handleTrashPurge)
+}
+
+func (s *Server) handleTrashPage(w http.ResponseWriter, r *http.Request) {
+	if !s.AllowWrite {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	entries, err := s.Trash.List()
+	if err != nil {
+		log.Println("[ERROR]: endpoint '/trash':", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	t := parseTemplates("templates/trash.html")
+	if err := t.Execute(w, TrashTemplateData{Entries: entries}); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Server) handleAPITrash(w http.ResponseWriter, r *http.Request) {
+	if !s.AllowWrite {
+		writeAPIError(w, http.StatusForbidden, "file management is disabled")
+		return
+	}
+	entries, err := s.Trash.List()
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func trashErrorStatus(err error) int {
+	if errors.Is(err, ErrTrashEntryNotFound) {
+		return http.StatusNotFound
+	}
+	return fileOpErrorStatus(err)
+}
+
+func (s *Server) handleTrashRestore(w http.ResponseWriter, r *http.Request) {
+	if !s.AllowWrite {
+		writeAPIError(w, http.StatusForbidden, "file management is disabled")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	id := r.URL.Query().Get("id")
+	trashed, err := s.Trash.Get(id)
+	if err != nil {
+		writeAPIError(w, trashErrorStatus(err), err.Error())
+		return
+	}
+	target, err := s.ResolvePath(trashed.OriginalPath)
+	if err != nil {
+		writeAPIResolveError(w, "/api/v1/trash/restore", err)
+		return
+	}
+	log.Println("[INFO]: endpoint '/api/v1/trash/restore': restoring", trashed.OriginalPath)
+	if _, err := s.Trash.Restore(id, target); err != nil {
+		log.Println("[ERROR]: endpoint '/api/v1/trash/restore':", err)
+		writeAPIError(w, trashErrorStatus(err), err.Error())
+		return
+	}
+	if r.Header.Get("HX-Request") == "true" {
+		w.Header().Set("HX-Refresh", "true")
+	}
+	writeJSON(w, http.StatusOK, trashed)
+}
+
+func (s *Server) handleTrashPurge(w http.ResponseWriter, r *http.Request) {
+	if !s.AllowWrite {
+		writeAPIError(w, http.StatusForbidden, "file management is disabled")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	id := r.URL.Query().Get("id")
+	log.Println("[INFO]: endpoint '/api/v1/trash/purge': permanently deleting", id)
+	if err := s.Trash.Purge(id); err != nil {
+		log.Println("[ERROR]: endpoint '/api/v1/trash/purge':", err)
+		writeAPIError(w, trashErrorStatus(err), err.Error())
+		return
+	}
+	if r.Header.Get("HX-Request") == "true" {
+		// htmx does not swap 204 responses, and the row is removed by swapping.
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,475 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// tus 1.0 resumable uploads, see https://tus.io/protocols/resumable-upload.
+// Uploads are created with POST /tus/, whose Upload-Metadata must carry the
+// filename and the folder (path) to upload to, and optionally the sha256
+// checksum of the whole file in hex and what to do if the file exists
+// (conflict, see ConflictPolicy).
+const (
+	tusVersion            = "1.0.0"
+	tusExtensions         = "creation,creation-with-upload,termination,checksum,expiration"
+	tusChecksumAlgorithms = "sha1,sha256,md5"
+	tusContentType        = "application/offset+octet-stream"
+	tusEndpoint           = "/tus/"
+)
+
+// StatusChecksumMismatch is defined by the tus checksum extension.
+const StatusChecksumMismatch = 460
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// parseTusMetadata decodes Upload-Metadata: comma separated pairs of a key and
+// a base64 value, where the value may be left out.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := map[string]string{}
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("invalid Upload-Metadata")
+		}
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.New("invalid Upload-Metadata")
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+func tusChecksumHash(algorithm string) (hash.Hash, bool) {
+	switch algorithm {
+	case "sha1":
+		return sha1.New(), true
+	case "sha256":
+		return sha256.New(), true
+	case "md5":
+		return md5.New(), true
+	}
+	return nil, false
+}
+
+func writeTusError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(message))
+}
+
+func (s *Server) registerTus(serveMux *http.ServeMux) {
+	serveMux.HandleFunc(tusEndpoint, s.handleTus)
+}
+
+func (s *Server) handleTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" && method == http.MethodPost {
+		method = override
+	}
+	if method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtensions)
+		w.Header().Set("Tus-Checksum-Algorithm", tusChecksumAlgorithms)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeTusError(w, http.StatusPreconditionFailed, "unsupported tus version")
+		return
+	}
+	if !s.Uploads || s.uploadManager == nil {
+		writeTusError(w, http.StatusForbidden, "uploads are disabled")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, tusEndpoint)
+	if id == "" {
+		if method != http.MethodPost {
+			writeTusError(w, http.StatusMethodNotAllowed, "use POST to create an upload")
+			return
+		}
+		s.handleTusCreate(w, r)
+		return
+	}
+	upload, ok := s.uploadManager.get(id)
+	if !ok {
+		writeTusError(w, http.StatusNotFound, "upload not found")
+		return
+	}
+	switch method {
+	case http.MethodHead:
+		s.handleTusHead(w, upload)
+	case http.MethodPatch:
+		s.handleTusPatch(w, r, upload)
+	case http.MethodDelete:
+		s.handleTusDelete(w, upload)
+	default:
+		writeTusError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *Server) handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeTusError(w, http.StatusBadRequest, "Upload-Defer-Length is not supported")
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeTusError(w, http.StatusBadRequest, "invalid Upload-Length")
+		return
+	}
+	rawMetadata := r.Header.Get("Upload-Metadata")
+	metadata, err := parseTusMetadata(rawMetadata)
+	if err != nil {
+		writeTusError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	fileName, err := SanitizeFileName(metadata["filename"])
+	if err != nil {
+		writeTusError(w, http.StatusBadRequest, "invalid filename in Upload-Metadata")
+		return
+	}
+	conflict, ok := ParseConflictPolicy(metadata["conflict"])
+	if !ok {
+		writeTusError(w, http.StatusBadRequest, "invalid conflict in Upload-Metadata")
+		return
+	}
+	folder := path.Clean("/" + metadata["path"])
+	destPath, err := s.resolveUploadDest(folder, fileName)
+	if errors.Is(err, ErrNotAFolder) {
+		writeTusError(w, http.StatusBadRequest, "path in Upload-Metadata is not a folder")
+		return
+	}
+	if err != nil {
+		WriteResolveError(w, tusEndpoint, err)
+		return
+	}
+	// Refuse early rather than after the whole file has been sent. The check
+	// is made again once it has, in case the file shows up in the meantime.
+	if _, err := os.Lstat(destPath); err == nil && conflict == ConflictReject {
+		writeTusError(w, http.StatusConflict, ErrDestinationExists.Error())
+		return
+	}
+	id, err := newUploadID()
+	if err != nil {
+		log.Println("[ERROR]: endpoint '/tus/':", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	upload := &TusUpload{
+		ID:       id,
+		Length:   length,
+		Metadata: rawMetadata,
+		FileName: fileName,
+		Checksum: strings.ToLower(metadata["checksum"]),
+		Folder:   folder,
+		Conflict: conflict,
+	}
+	if err := s.uploadManager.create(upload, filepath.Dir(destPath)); err != nil {
+		log.Println("[ERROR]: endpoint '/tus/':", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Println("[INFO]: endpoint '/tus/': created upload", id, "for", destPath)
+
+	w.Header().Set("Location", tusEndpoint+id)
+	s.setTusExpires(w, upload)
+	// An empty file is finished as soon as it is created
+	if r.Header.Get("Content-Type") == tusContentType || length == 0 {
+		upload.mu.Lock()
+		defer upload.mu.Unlock()
+		offset, status, err := s.receiveTusChunk(r, upload, 0)
+		if err != nil {
+			writeTusError(w, status, err.Error())
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) setTusExpires(w http.ResponseWriter, upload *TusUpload) {
+	if state, _, _ := upload.Progress(); state.Finished() {
+		return
+	}
+	if expires := s.uploadManager.Expires(upload); !expires.IsZero() {
+		w.Header().Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+func (s *Server) handleTusHead(w http.ResponseWriter, upload *TusUpload) {
+	_, offset, _ := upload.Progress()
+	s.setTusExpires(w, upload)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if upload.Metadata != "" {
+		w.Header().Set("Upload-Metadata", upload.Metadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) handleTusPatch(w http.ResponseWriter, r *http.Request, upload *TusUpload) {
+	if r.Header.Get("Content-Type") != tusContentType {
+		writeTusError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+tusContentType)
+		return
+	}
+	clientOffset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || clientOffset < 0 {
+		writeTusError(w, http.StatusBadRequest, "invalid Upload-Offset")
+		return
+	}
+	// Only one request may write to an upload at a time
+	if !upload.mu.TryLock() {
+		writeTusError(w, http.StatusLocked, "upload is already being written to")
+		return
+	}
+	defer upload.mu.Unlock()
+	if state, _, _ := upload.Progress(); state.Finished() {
+		writeTusError(w, http.StatusNotFound, "upload not found")
+		return
+	}
+	offset, status, err := s.receiveTusChunk(r, upload, clientOffset)
+	if err != nil {
+		writeTusError(w, status, err.Error())
+		return
+	}
+	s.setTusExpires(w, upload)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkTusPartFile makes sure the part file holds exactly what the journal
+// says was received, and returns that offset.
+func (s *Server) checkTusPartFile(upload *TusUpload) (int64, error) {
+	_, offset, _ := upload.Progress()
+	info, err := os.Stat(upload.TmpPath)
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() > offset {
+		return offset, os.Truncate(upload.TmpPath, offset)
+	}
+	if info.Size() < offset {
+		offset = info.Size()
+		return offset, s.uploadManager.setOffset(upload, offset, nil)
+	}
+	return offset, nil
+}
+
+// receiveTusChunk appends the request body to the upload, which must be at
+// clientOffset, and finishes the upload once it is complete. The caller holds
+// upload.mu. On failure it returns the status to answer with.
+func (s *Server) receiveTusChunk(r *http.Request, upload *TusUpload, clientOffset int64) (int64, int, error) {
+	offset, err := s.checkTusPartFile(upload)
+	if err != nil {
+		log.Println("[ERROR]: endpoint '/tus/':", err)
+		return 0, http.StatusInternalServerError, err
+	}
+	if clientOffset != offset {
+		return offset, http.StatusConflict, errors.New("Upload-Offset does not match the upload, use HEAD to find it")
+	}
+	var checksum hash.Hash
+	var expected []byte
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		algorithm, encoded, _ := strings.Cut(header, " ")
+		var ok bool
+		if checksum, ok = tusChecksumHash(algorithm); !ok {
+			return offset, http.StatusBadRequest, errors.New("unsupported checksum algorithm")
+		}
+		if expected, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return offset, http.StatusBadRequest, errors.New("invalid Upload-Checksum")
+		}
+	}
+
+	var fileHash hash.Hash
+	if upload.Checksum != "" {
+		if fileHash, err = upload.partHash(offset); err != nil {
+			log.Println("[ERROR]: endpoint '/tus/':", err)
+			return offset, http.StatusInternalServerError, err
+		}
+	}
+
+	tmpFile, err := os.OpenFile(upload.TmpPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Println("[ERROR]: endpoint '/tus/':", err)
+		return offset, http.StatusInternalServerError, err
+	}
+	defer tmpFile.Close()
+	stopKeepAlive := s.keepAliveWhileRunning()
+	defer stopKeepAlive()
+	limit := upload.Length - offset
+	if s.UploadRequestBytes > 0 && s.UploadRequestBytes < limit {
+		limit = s.UploadRequestBytes
+	}
+	body := io.Reader(http.MaxBytesReader(nil, r.Body, limit))
+	// The body goes straight to disk, hashed on the way
+	writers := []io.Writer{tmpFile}
+	if checksum != nil {
+		writers = append(writers, checksum)
+	}
+	if fileHash != nil {
+		writers = append(writers, fileHash)
+	}
+	written, copyErr := io.Copy(io.MultiWriter(writers...), body)
+	if checksum != nil && copyErr == nil && !bytes.Equal(checksum.Sum(nil), expected) {
+		copyErr = ErrChecksumMismatch
+	}
+	var maxBytesErr *http.MaxBytesError
+	// A checksum covers the whole request and a request that is too long is
+	// wrong as a whole, so nothing of either can be kept
+	if copyErr != nil && (checksum != nil || errors.As(copyErr, &maxBytesErr)) {
+		if err := tmpFile.Truncate(offset); err != nil {
+			log.Println("[ERROR]: endpoint '/tus/':", err)
+		}
+		written = 0
+	}
+	if written > 0 {
+		offset += written
+		var hashState []byte
+		if fileHash != nil {
+			hashState, _ = fileHash.(encoding.BinaryMarshaler).MarshalBinary()
+		}
+		if err := s.uploadManager.setOffset(upload, offset, hashState); err != nil {
+			log.Println("[ERROR]: endpoint '/tus/':", err)
+		}
+	}
+	switch {
+	case errors.Is(copyErr, ErrChecksumMismatch):
+		return offset, StatusChecksumMismatch, copyErr
+	case errors.As(copyErr, &maxBytesErr) && limit < upload.Length-offset:
+		return offset, http.StatusRequestEntityTooLarge, fmt.Errorf("requests can be at most %d bytes", limit)
+	case errors.As(copyErr, &maxBytesErr):
+		return offset, http.StatusRequestEntityTooLarge, errors.New("request is longer than the rest of the upload")
+	case copyErr != nil:
+		// Whatever arrived before the connection dropped is kept, the client
+		// can find where to resume with HEAD
+		log.Println("[INFO]: endpoint '/tus/': upload", upload.ID, "interrupted at", offset, copyErr)
+		return offset, http.StatusInternalServerError, copyErr
+	}
+
+	if offset == upload.Length {
+		tmpFile.Close()
+		if status, err := s.finishTusUpload(upload); err != nil {
+			return offset, status, err
+		}
+	}
+	return offset, 0, nil
+}
+
+// resolveUploadDest resolves where fileName goes in folder, which is relative
+// to the shared folder.
+func (s *Server) resolveUploadDest(folder string, fileName string) (string, error) {
+	dirPath, err := s.ResolvePath(folder)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(dirPath); err != nil || !info.IsDir() {
+		return "", ErrNotAFolder
+	}
+	destPath, err := s.ResolvePath(path.Join(folder, fileName))
+	if err != nil || filepath.Dir(destPath) != dirPath {
+		return "", ErrForbiddenPath
+	}
+	return destPath, nil
+}
+
+func (s *Server) finishTusUpload(upload *TusUpload) (int, error) {
+	if err := s.uploadManager.setState(upload, UploadVerifying); err != nil {
+		log.Println("[ERROR]: endpoint '/tus/':", err)
+		return http.StatusInternalServerError, err
+	}
+	if upload.Checksum != "" {
+		if err := upload.checksumMatches(); err != nil {
+			log.Println("[ERROR]: endpoint '/tus/':", upload.ID, err)
+			s.failTusUpload(upload)
+			return StatusChecksumMismatch, err
+		}
+	}
+	// The shared folder may have changed since the upload was created, or a
+	// folder on the way been replaced by a link, so the destination is
+	// resolved again
+	destPath, err := s.resolveUploadDest(upload.Folder, upload.FileName)
+	if err == nil {
+		err = s.uploadManager.stage(upload, destPath)
+	}
+	if err == nil {
+		destPath, err = upload.place(destPath)
+	}
+	if err != nil {
+		log.Println("[ERROR]: endpoint '/tus/':", upload.ID, err)
+		s.failTusUpload(upload)
+		return fileOpErrorStatus(err), err
+	}
+	if err := s.uploadManager.setState(upload, UploadDone); err != nil {
+		log.Println("[ERROR]: endpoint '/tus/':", err)
+	}
+	log.Println("[INFO]: endpoint '/tus/': finished upload", upload.ID, "to", destPath)
+	return 0, nil
+}
+
+// checksumMatches compares the checksum the upload was created with against
+// the hash of everything received.
+func (u *TusUpload) checksumMatches() error {
+	fileHash, err := u.partHash(u.Length)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(fileHash.Sum(nil)) != u.Checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+func (s *Server) failTusUpload(upload *TusUpload) {
+	if err := s.uploadManager.setState(upload, UploadFailed); err != nil {
+		log.Println("[ERROR]: endpoint '/tus/':", err)
+	}
+}
+
+func (s *Server) handleTusDelete(w http.ResponseWriter, upload *TusUpload) {
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	err := s.uploadManager.setState(upload, UploadCancelled)
+	if errors.Is(err, ErrUploadFinished) {
+		writeTusError(w, http.StatusNotFound, "upload not found")
+		return
+	}
+	if err != nil {
+		log.Println("[ERROR]: endpoint '/tus/':", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
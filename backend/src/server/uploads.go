@@ -0,0 +1,507 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadState is where an upload is in its life. Uploads start out created,
+// are receiving once data arrives and verifying while their checksum is
+// checked. Done, cancelled and failed uploads are finished and no longer kept.
+type UploadState string
+
+const (
+	UploadCreated   UploadState = "created"
+	UploadReceiving UploadState = "receiving"
+	UploadVerifying UploadState = "verifying"
+	UploadDone      UploadState = "done"
+	UploadCancelled UploadState = "cancelled"
+	UploadFailed    UploadState = "failed"
+)
+
+var uploadTransitions = map[UploadState][]UploadState{
+	UploadCreated:   {UploadReceiving, UploadVerifying, UploadCancelled, UploadFailed},
+	UploadReceiving: {UploadVerifying, UploadCancelled, UploadFailed},
+	UploadVerifying: {UploadDone, UploadFailed},
+}
+
+var ErrUploadFinished = errors.New("upload is already finished")
+
+func (state UploadState) Finished() bool {
+	return state == UploadDone || state == UploadCancelled || state == UploadFailed
+}
+
+// ConflictPolicy decides what happens when a file with the upload's name
+// already exists: the upload is refused, replaces the file, is saved as
+// "name (1).ext", or takes the name while the existing file is renamed to
+// "name (1).ext".
+type ConflictPolicy string
+
+const (
+	ConflictReject    ConflictPolicy = "reject"
+	ConflictOverwrite ConflictPolicy = "overwrite"
+	ConflictRename    ConflictPolicy = "rename"
+	ConflictKeepBoth  ConflictPolicy = "keepboth"
+)
+
+const DefaultConflictPolicy = ConflictRename
+
+func ParseConflictPolicy(value string) (ConflictPolicy, bool) {
+	switch policy := ConflictPolicy(strings.ToLower(value)); policy {
+	case "":
+		return DefaultConflictPolicy, true
+	case ConflictReject, ConflictOverwrite, ConflictRename, ConflictKeepBoth:
+		return policy, true
+	}
+	return "", false
+}
+
+// TusUpload is an upload in progress. It is journaled to <id>.json in the
+// manager's folder so that it can be resumed after the server restarts. The
+// data received so far goes to <id>.part in a hidden folder next to where the
+// upload ends up, so finishing it is a rename on the same filesystem.
+type TusUpload struct {
+	ID       string `json:"id"`
+	Length   int64  `json:"length"`
+	Metadata string `json:"metadata"`
+	FileName string `json:"fileName"`
+	Checksum string `json:"checksum,omitempty"`
+	// Folder is where the upload goes, relative to the shared folder
+	Folder string `json:"folder"`
+	// Conflict is empty in journals written before it was kept, which
+	// means DefaultConflictPolicy
+	Conflict ConflictPolicy `json:"conflict,omitempty"`
+	Created  time.Time      `json:"created"`
+	State    UploadState    `json:"state"`
+	// Offset is how much has been received and acknowledged. Anything in the
+	// part file past it is discarded.
+	Offset  int64     `json:"offset"`
+	Updated time.Time `json:"updated"`
+	// HashState is the sha256 of the part file up to Offset, kept for uploads
+	// with a checksum so that it doesn't have to be reread when they finish
+	HashState []byte `json:"hashState,omitempty"`
+	// TmpPath is empty in journals written while part files were kept in
+	// the manager's folder
+	TmpPath string `json:"partPath,omitempty"`
+	// mu is held by the request writing to the upload, progress guards
+	// State, Offset, Updated and HashState
+	mu       sync.Mutex
+	progress sync.Mutex
+}
+
+func (u *TusUpload) Progress() (UploadState, int64, time.Time) {
+	u.progress.Lock()
+	defer u.progress.Unlock()
+	return u.State, u.Offset, u.Updated
+}
+
+// UploadManager keeps the uploads that haven't finished yet and moves them
+// through their states. Uploads not written to for Expiry are abandoned and
+// cancelled.
+type UploadManager struct {
+	Dir     string
+	Expiry  time.Duration
+	mu      sync.Mutex
+	uploads map[string]*TusUpload
+}
+
+func NewUploadManager(dir string, expiry time.Duration) (*UploadManager, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	m := &UploadManager{Dir: dir, Expiry: expiry, uploads: map[string]*TusUpload{}}
+	m.load()
+	return m, nil
+}
+
+func (m *UploadManager) journalPath(id string) string {
+	return filepath.Join(m.Dir, id+".json")
+}
+
+// uploadStagingDir is the hidden folder part files are kept in, inside the
+// folder they are uploaded to.
+const uploadStagingDir = ".deckyfileserver-uploads"
+
+func stagingPath(dir string, id string) string {
+	return filepath.Join(dir, uploadStagingDir, id+".part")
+}
+
+func (m *UploadManager) legacyPartPath(id string) string {
+	return filepath.Join(m.Dir, id+".part")
+}
+
+// load picks up the uploads journaled by a previous run. A part file that is
+// longer than the journal says holds data from a request that never finished,
+// which is cut off, and one that is shorter wins over the journal.
+func (m *UploadManager) load() {
+	journals, err := filepath.Glob(filepath.Join(m.Dir, "*.json"))
+	if err != nil {
+		log.Println("[ERROR]: Upload journal:", err)
+		return
+	}
+	for _, journalPath := range journals {
+		upload, err := readUploadJournal(journalPath)
+		if err != nil {
+			log.Println("[ERROR]: Upload journal:", journalPath, err)
+			continue
+		}
+		if upload.TmpPath == "" {
+			upload.TmpPath = m.legacyPartPath(upload.ID)
+		}
+		info, err := os.Stat(upload.TmpPath)
+		if err != nil {
+			log.Println("[INFO]: Upload journal: dropping", upload.ID, err)
+			os.Remove(journalPath)
+			continue
+		}
+		if info.Size() > upload.Offset {
+			if err := os.Truncate(upload.TmpPath, upload.Offset); err != nil {
+				log.Println("[ERROR]: Upload journal:", upload.ID, err)
+				continue
+			}
+		} else if info.Size() < upload.Offset {
+			upload.Offset = info.Size()
+			upload.HashState = nil
+		}
+		// Journals from before states were kept have none, and a crash while
+		// verifying means verifying again once the client resumes
+		if upload.State == "" || upload.State == UploadVerifying {
+			upload.State = UploadReceiving
+		}
+		if upload.Offset == 0 {
+			upload.State = UploadCreated
+		}
+		m.uploads[upload.ID] = upload
+	}
+	if len(m.uploads) > 0 {
+		log.Println("[INFO]: Upload journal: resuming", len(m.uploads), "uploads")
+	}
+	removeOrphanedParts(m.Dir)
+}
+
+func readUploadJournal(journalPath string) (*TusUpload, error) {
+	data, err := os.ReadFile(journalPath)
+	if err != nil {
+		return nil, err
+	}
+	upload := &TusUpload{}
+	if err := json.Unmarshal(data, upload); err != nil {
+		return nil, err
+	}
+	if upload.ID == "" || strings.ContainsAny(upload.ID, "/\\.") {
+		return nil, errors.New("invalid upload id")
+	}
+	if upload.Folder == "" {
+		return nil, errors.New("journal has no folder")
+	}
+	return upload, nil
+}
+
+func removeOrphanedParts(dir string) {
+	parts, _ := filepath.Glob(filepath.Join(dir, "*.part"))
+	for _, part := range parts {
+		if _, err := os.Stat(strings.TrimSuffix(part, ".part") + ".json"); errors.Is(err, fs.ErrNotExist) {
+			os.Remove(part)
+		}
+	}
+}
+
+// writeJournal saves the upload, replacing the journal atomically so that a
+// crash can't leave it half written.
+func (m *UploadManager) writeJournal(upload *TusUpload) error {
+	upload.progress.Lock()
+	data, err := json.Marshal(upload)
+	upload.progress.Unlock()
+	if err != nil {
+		return err
+	}
+	tmpPath := m.journalPath(upload.ID) + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, m.journalPath(upload.ID))
+}
+
+// create journals a new upload going to dir and creates its empty part file.
+// The journal is written first, so a crash in between leaves a journal
+// without a part file, which load drops, rather than a stray part file.
+func (m *UploadManager) create(upload *TusUpload, dir string) error {
+	upload.TmpPath = stagingPath(dir, upload.ID)
+	upload.State = UploadCreated
+	upload.Created = time.Now()
+	upload.Updated = upload.Created
+	if err := m.writeJournal(upload); err != nil {
+		return err
+	}
+	err := os.MkdirAll(filepath.Dir(upload.TmpPath), 0755)
+	if err == nil {
+		var tmpFile *os.File
+		tmpFile, err = os.OpenFile(upload.TmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			tmpFile.Close()
+		}
+	}
+	if err != nil {
+		os.Remove(m.journalPath(upload.ID))
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploads[upload.ID] = upload
+	return nil
+}
+
+func (m *UploadManager) get(id string) (*TusUpload, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	upload, ok := m.uploads[id]
+	return upload, ok
+}
+
+// setOffset records that the upload has received offset bytes, along with the
+// hash state of the part file at that point, if there is one.
+func (m *UploadManager) setOffset(upload *TusUpload, offset int64, hashState []byte) error {
+	upload.progress.Lock()
+	if upload.State.Finished() {
+		upload.progress.Unlock()
+		return ErrUploadFinished
+	}
+	if upload.State == UploadCreated && offset > 0 {
+		upload.State = UploadReceiving
+	}
+	upload.Offset = offset
+	upload.HashState = hashState
+	upload.Updated = time.Now()
+	upload.progress.Unlock()
+	return m.writeJournal(upload)
+}
+
+// setState moves the upload to state, if its current state allows it. Once an
+// upload is finished it is forgotten and its files are removed, except for the
+// part file of a done upload, which has been moved to its destination.
+func (m *UploadManager) setState(upload *TusUpload, state UploadState) error {
+	upload.progress.Lock()
+	from := upload.State
+	if !slices.Contains(uploadTransitions[from], state) {
+		upload.progress.Unlock()
+		if from.Finished() {
+			return ErrUploadFinished
+		}
+		return fmt.Errorf("upload %s can't go from %s to %s", upload.ID, from, state)
+	}
+	upload.State = state
+	upload.progress.Unlock()
+	if state.Finished() {
+		return m.remove(upload)
+	}
+	return m.writeJournal(upload)
+}
+
+// stage moves the part file next to destPath if it isn't there already, e.g.
+// because the shared folder changed since the upload was created, so that
+// place can rename it.
+func (m *UploadManager) stage(upload *TusUpload, destPath string) error {
+	staged := stagingPath(filepath.Dir(destPath), upload.ID)
+	if upload.TmpPath == staged {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(staged), 0755); err != nil {
+		return err
+	}
+	if err := moveEntry(upload.TmpPath, staged); err != nil {
+		return err
+	}
+	previous := upload.TmpPath
+	upload.TmpPath = staged
+	removeStagingDir(previous)
+	return m.writeJournal(upload)
+}
+
+// place renames the finished part file to destPath following the upload's
+// conflict policy, and returns where it ended up. Names are claimed with an
+// empty placeholder that the part file is then renamed over, so a file that
+// shows up in the meantime is never replaced unless the policy says so.
+func (u *TusUpload) place(destPath string) (string, error) {
+	policy, _ := ParseConflictPolicy(string(u.Conflict))
+	if info, err := os.Lstat(destPath); err == nil && info.IsDir() {
+		return "", ErrDestinationExists
+	}
+	switch policy {
+	case ConflictOverwrite:
+		// Renaming replaces the existing file in one step
+		return destPath, os.Rename(u.TmpPath, destPath)
+	case ConflictKeepBoth:
+		if _, err := os.Lstat(destPath); err == nil {
+			aside, err := claimFreeName(destPath)
+			if err != nil {
+				return "", err
+			}
+			if err := os.Rename(destPath, aside); err != nil {
+				os.Remove(aside)
+				return "", err
+			}
+		}
+	}
+	err := claimName(destPath)
+	if errors.Is(err, fs.ErrExist) && policy != ConflictReject {
+		destPath, err = claimFreeName(destPath)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return "", ErrDestinationExists
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(u.TmpPath, destPath); err != nil {
+		os.Remove(destPath)
+		return "", err
+	}
+	return destPath, nil
+}
+
+func claimName(filePath string) error {
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// claimFreeName claims the first of "name (1).ext", "name (2).ext" and so on
+// that doesn't exist yet.
+func claimFreeName(filePath string) (string, error) {
+	dir, name := filepath.Split(filePath)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if base == "" {
+		base, ext = name, ""
+	}
+	for i := 1; i < 10000; i++ {
+		candidate := filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+		err := claimName(candidate)
+		if err == nil {
+			return candidate, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+	}
+	return "", ErrDestinationExists
+}
+
+// remove forgets the upload and deletes its files, if they are still there.
+// The part file goes first, so a crash in between can't leave it behind.
+func (m *UploadManager) remove(upload *TusUpload) error {
+	m.mu.Lock()
+	delete(m.uploads, upload.ID)
+	m.mu.Unlock()
+	if err := os.Remove(upload.TmpPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	removeStagingDir(upload.TmpPath)
+	if err := os.Remove(m.journalPath(upload.ID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// removeStagingDir removes the staging folder partPath was in once no other
+// upload is using it.
+func removeStagingDir(partPath string) {
+	if dir := filepath.Dir(partPath); filepath.Base(dir) == uploadStagingDir {
+		os.Remove(dir)
+	}
+}
+
+// partHash returns the sha256 of the part file up to offset, picking up from
+// the saved hash state. If there isn't one, e.g. because the part file turned
+// out shorter than the journal, the part file is hashed again.
+func (u *TusUpload) partHash(offset int64) (hash.Hash, error) {
+	h := sha256.New()
+	u.progress.Lock()
+	hashState := u.HashState
+	u.progress.Unlock()
+	if hashState != nil {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(hashState); err == nil {
+			return h, nil
+		}
+		h.Reset()
+	}
+	if offset == 0 {
+		return h, nil
+	}
+	file, err := os.Open(u.TmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := io.CopyN(h, file, offset); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// List returns the uploads that haven't finished, oldest first.
+func (m *UploadManager) List() []*TusUpload {
+	m.mu.Lock()
+	uploads := make([]*TusUpload, 0, len(m.uploads))
+	for _, upload := range m.uploads {
+		uploads = append(uploads, upload)
+	}
+	m.mu.Unlock()
+	slices.SortFunc(uploads, func(a, b *TusUpload) int {
+		return a.Created.Compare(b.Created)
+	})
+	return uploads
+}
+
+// Expires is when the upload will be removed if nothing more is sent, or the
+// zero time if uploads never expire.
+func (m *UploadManager) Expires(upload *TusUpload) time.Time {
+	if m.Expiry <= 0 {
+		return time.Time{}
+	}
+	_, _, updated := upload.Progress()
+	return updated.Add(m.Expiry)
+}
+
+// ExpireAbandoned cancels uploads that haven't been written to for Expiry.
+// Uploads that are being written to right now are left alone.
+func (m *UploadManager) ExpireAbandoned() {
+	if m.Expiry <= 0 {
+		return
+	}
+	for _, upload := range m.List() {
+		if time.Now().Before(m.Expires(upload)) || !upload.mu.TryLock() {
+			continue
+		}
+		log.Println("[INFO]: Upload expired:", upload.ID, path.Join(upload.Folder, upload.FileName))
+		if err := m.setState(upload, UploadCancelled); err != nil && !errors.Is(err, ErrUploadFinished) {
+			log.Println("[ERROR]: Upload expiry:", err)
+		}
+		upload.mu.Unlock()
+	}
+}
+
+func (m *UploadManager) RunExpiry(interval time.Duration) {
+	m.ExpireAbandoned()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.ExpireAbandoned()
+	}
+}
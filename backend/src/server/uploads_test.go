@@ -0,0 +1,49 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadPlace(t *testing.T) {
+	tests := []struct {
+		policy  ConflictPolicy
+		want    map[string]string
+		wantErr error
+	}{
+		{policy: ConflictRename, want: map[string]string{"f.txt": "old", "f (1).txt": "new"}},
+		{policy: ConflictOverwrite, want: map[string]string{"f.txt": "new"}},
+		{policy: ConflictKeepBoth, want: map[string]string{"f.txt": "new", "f (1).txt": "old"}},
+		{policy: ConflictReject, want: map[string]string{"f.txt": "old"}, wantErr: ErrDestinationExists},
+	}
+	for _, test := range tests {
+		t.Run(string(test.policy), func(t *testing.T) {
+			dir := t.TempDir()
+			destPath := filepath.Join(dir, "f.txt")
+			if err := os.WriteFile(destPath, []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			upload := &TusUpload{ID: "id", Conflict: test.policy, TmpPath: stagingPath(dir, "id")}
+			if err := os.MkdirAll(filepath.Dir(upload.TmpPath), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(upload.TmpPath, []byte("new"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := upload.place(destPath); !errors.Is(err, test.wantErr) {
+				t.Fatalf("place = %v, want %v", err, test.wantErr)
+			}
+			for name, content := range test.want {
+				if data, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(data) != content {
+					t.Errorf("%s = %q, %v, want %q", name, data, err, content)
+				}
+			}
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != len(test.want)+1 {
+				t.Errorf("%d entries left next to the upload, want %d", len(entries), len(test.want)+1)
+			}
+		})
+	}
+}
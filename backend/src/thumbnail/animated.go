@@ -0,0 +1,360 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+
+	"github.com/HugoSmits86/nativewebp"
+	"golang.org/x/image/webp"
+)
+
+// ErrNotAnimated is returned by an Animator for files that turn out to have a
+// single frame. The generator makes a still thumbnail instead.
+var ErrNotAnimated = errors.New("file is not animated")
+
+var errAnimationTooLarge = errors.New("animation is too large")
+
+// maxAnimatedFrames and maxAnimatedBytes cap animated thumbnails. Frames are
+// dropped evenly, keeping the overall timing, until both are met.
+const (
+	maxAnimatedFrames = 50
+	maxAnimatedBytes  = 1 << 20
+)
+
+// maxAnimationPixels caps the canvas of an animation and each of its frames
+// before anything is allocated, as sizes come straight from the file header.
+const maxAnimationPixels = 1 << 24
+
+func checkAnimationSize(width, height int) error {
+	if width <= 0 || height <= 0 || width > maxAnimationPixels/height {
+		return errAnimationTooLarge
+	}
+	return nil
+}
+
+// Animation is a decoded animation. Every frame is the full canvas, with
+// disposal and blending already applied.
+type Animation struct {
+	Frames []image.Image
+	// Delays are in milliseconds
+	Delays []int
+}
+
+// Animator is implemented by providers that can make animated thumbnails,
+// which clients ask for with Options.Animated.
+type Animator interface {
+	CreateAnimation(filePath string, opts Options) (*Animation, error)
+}
+
+// animationBuilder collects frames as they are composed, keeping at most
+// maxAnimatedFrames of them, evenly spread, and resizing each straight away.
+// Only the canvas is ever full size, however large or long the source is.
+type animationBuilder struct {
+	anim   Animation
+	resize func(image.Image) image.Image
+	stride int
+	// limit stops decoding once that many frames are kept, 0 for no limit
+	limit int
+	count int
+}
+
+func newAnimationBuilder(frames int, opts Options, limit int) *animationBuilder {
+	return &animationBuilder{
+		resize: opts.resize,
+		stride: max(1, (frames+maxAnimatedFrames-1)/maxAnimatedFrames),
+		limit:  limit,
+	}
+}
+
+// add adds the canvas as the next frame. The delays of dropped frames go to
+// the kept frame before them.
+func (b *animationBuilder) add(canvas image.Image, delay int) {
+	if b.count%b.stride == 0 {
+		b.anim.Frames = append(b.anim.Frames, b.resize(canvas))
+		b.anim.Delays = append(b.anim.Delays, 0)
+	}
+	b.anim.Delays[len(b.anim.Delays)-1] += delay
+	b.count++
+}
+
+func (b *animationBuilder) full() bool {
+	return b.limit > 0 && len(b.anim.Frames) >= b.limit
+}
+
+// reduce keeps every stride-th frame, adding the delays of the dropped frames
+// to the one before them.
+func (a *Animation) reduce(stride int) *Animation {
+	reduced := &Animation{}
+	for i, frame := range a.Frames {
+		if i%stride == 0 {
+			reduced.Frames = append(reduced.Frames, frame)
+			reduced.Delays = append(reduced.Delays, 0)
+		}
+		reduced.Delays[len(reduced.Delays)-1] += a.Delays[i]
+	}
+	return reduced
+}
+
+// decodeAnimation decodes an animated GIF or WebP, with its frames already
+// resized for opts.
+func decodeAnimation(data []byte, opts Options) (*Animation, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return decodeGIF(data, opts)
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return decodeAnimatedWebP(data, opts, 0)
+	}
+	return nil, ErrNotAnimated
+}
+
+func decodeGIF(data []byte, opts Options) (*Animation, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkAnimationSize(config.Width, config.Height); err != nil {
+		return nil, err
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) < 2 {
+		return nil, ErrNotAnimated
+	}
+	builder := newAnimationBuilder(len(g.Image), opts, 0)
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image {
+		// Let the decoded frames go as soon as they have been drawn
+		g.Image[i] = nil
+		var previous *image.NRGBA
+		if g.Disposal[i] == gif.DisposalPrevious {
+			previous = image.NewNRGBA(canvas.Bounds())
+			draw.Draw(previous, previous.Bounds(), canvas, image.Point{}, draw.Src)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		builder.add(canvas, g.Delay[i]*10)
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return &builder.anim, nil
+}
+
+// decodeAnimatedWebP splits an animated WebP into its frames. golang.org/x/image
+// only decodes stills, so each frame is rewrapped as one. With a limit it stops
+// once that many frames are kept, and a single frame is no error.
+func decodeAnimatedWebP(data []byte, opts Options, limit int) (*Animation, error) {
+	chunks, err := readWebPChunks(data[12:])
+	if err != nil {
+		return nil, err
+	}
+	frames := 0
+	for _, chunk := range chunks {
+		if chunk.id == "ANMF" {
+			frames++
+		}
+	}
+	var canvas *image.NRGBA
+	builder := newAnimationBuilder(frames, opts, limit)
+	for _, chunk := range chunks {
+		if builder.full() {
+			break
+		}
+		switch chunk.id {
+		case "VP8X":
+			if len(chunk.data) < 10 || chunk.data[0]&0x02 == 0 {
+				return nil, ErrNotAnimated
+			}
+			width, height := int(uint24(chunk.data[4:]))+1, int(uint24(chunk.data[7:]))+1
+			if err := checkAnimationSize(width, height); err != nil {
+				return nil, err
+			}
+			canvas = image.NewNRGBA(image.Rect(0, 0, width, height))
+		case "ANMF":
+			if canvas == nil || len(chunk.data) < 16 {
+				return nil, errors.New("invalid animated WebP")
+			}
+			x, y := int(uint24(chunk.data[0:]))*2, int(uint24(chunk.data[3:]))*2
+			width, height := int(uint24(chunk.data[6:]))+1, int(uint24(chunk.data[9:]))+1
+			delay, flags := int(uint24(chunk.data[12:])), chunk.data[15]
+			bounds := image.Rect(x, y, x+width, y+height)
+			if !bounds.In(canvas.Bounds()) {
+				return nil, errors.New("invalid animated WebP")
+			}
+			frame, err := decodeWebPFrame(chunk.data[16:], width, height)
+			if err != nil {
+				return nil, err
+			}
+			op := draw.Over
+			if flags&0x02 != 0 {
+				op = draw.Src
+			}
+			draw.Draw(canvas, bounds, frame, frame.Bounds().Min, op)
+			builder.add(canvas, delay)
+			if flags&0x01 != 0 {
+				draw.Draw(canvas, bounds, image.Transparent, image.Point{}, draw.Src)
+			}
+		}
+	}
+	if len(builder.anim.Frames) == 0 || (limit == 0 && frames < 2) {
+		return nil, ErrNotAnimated
+	}
+	return &builder.anim, nil
+}
+
+func decodeWebPFrame(data []byte, width, height int) (image.Image, error) {
+	chunks, err := readWebPChunks(data)
+	if err != nil {
+		return nil, err
+	}
+	var still []byte
+	for _, chunk := range chunks {
+		if chunk.id == "ALPH" {
+			vp8x := make([]byte, 10)
+			vp8x[0] = 0x10
+			putUint24(vp8x[4:], uint32(width-1))
+			putUint24(vp8x[7:], uint32(height-1))
+			still = appendWebPChunk(still, "VP8X", vp8x)
+		}
+		if chunk.id == "ALPH" || chunk.id == "VP8 " || chunk.id == "VP8L" {
+			still = appendWebPChunk(still, chunk.id, chunk.data)
+		}
+	}
+	// The frame's own header may claim a larger size than its ANMF chunk
+	stillData := riffWebP(still)
+	config, err := webp.DecodeConfig(bytes.NewReader(stillData))
+	if err != nil {
+		return nil, err
+	}
+	if config.Width > width || config.Height > height {
+		return nil, errors.New("invalid animated WebP")
+	}
+	return webp.Decode(bytes.NewReader(stillData))
+}
+
+type webpChunk struct {
+	id   string
+	data []byte
+}
+
+func readWebPChunks(data []byte) ([]webpChunk, error) {
+	var chunks []webpChunk
+	for len(data) >= 8 {
+		size := int(binary.LittleEndian.Uint32(data[4:]))
+		if size < 0 || size > len(data)-8 {
+			return nil, errors.New("invalid WebP chunk")
+		}
+		chunks = append(chunks, webpChunk{id: string(data[:4]), data: data[8 : 8+size]})
+		data = data[min(len(data), 8+size+size%2):]
+	}
+	return chunks, nil
+}
+
+func appendWebPChunk(dst []byte, id string, data []byte) []byte {
+	dst = append(dst, id...)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(data)))
+	dst = append(dst, data...)
+	if len(data)%2 == 1 {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+func riffWebP(chunks []byte) []byte {
+	data := []byte("RIFF")
+	data = binary.LittleEndian.AppendUint32(data, uint32(4+len(chunks)))
+	data = append(data, "WEBP"...)
+	return append(data, chunks...)
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// encodeAnimation encodes the already resized frames as an animated WebP, or
+// GIF for clients without WebP, dropping frames until it fits the byte cap.
+func (o Options) encodeAnimation(anim *Animation) ([]byte, error) {
+	stride := 1
+	for {
+		reduced := anim.reduce(stride)
+		var data []byte
+		var err error
+		if o.WebP {
+			data, err = encodeAnimatedWebP(reduced)
+		} else {
+			data, err = encodeGIF(reduced)
+		}
+		if err != nil || len(data) <= maxAnimatedBytes || len(reduced.Frames) == 1 {
+			return data, err
+		}
+		stride *= 2
+	}
+}
+
+// encodeAnimatedWebP wraps lossless stills from nativewebp, which can't write
+// animations itself, in ANMF frames.
+func encodeAnimatedWebP(anim *Animation) ([]byte, error) {
+	bounds := anim.Frames[0].Bounds()
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02 | 0x10
+	putUint24(vp8x[4:], uint32(bounds.Dx()-1))
+	putUint24(vp8x[7:], uint32(bounds.Dy()-1))
+	chunks := appendWebPChunk(nil, "VP8X", vp8x)
+	// Transparent background, loop forever
+	chunks = appendWebPChunk(chunks, "ANIM", make([]byte, 6))
+	for i, frame := range anim.Frames {
+		buf := bytes.NewBuffer(nil)
+		if err := nativewebp.Encode(buf, frame, nil); err != nil {
+			return nil, err
+		}
+		frameChunks, err := readWebPChunks(buf.Bytes()[12:])
+		if err != nil {
+			return nil, err
+		}
+		anmf := make([]byte, 16)
+		putUint24(anmf[6:], uint32(bounds.Dx()-1))
+		putUint24(anmf[9:], uint32(bounds.Dy()-1))
+		putUint24(anmf[12:], uint32(anim.Delays[i]))
+		// Replace the canvas rather than blending, since every frame is whole
+		anmf[15] = 0x02
+		for _, chunk := range frameChunks {
+			if chunk.id == "ALPH" || chunk.id == "VP8 " || chunk.id == "VP8L" {
+				anmf = appendWebPChunk(anmf, chunk.id, chunk.data)
+			}
+		}
+		chunks = appendWebPChunk(chunks, "ANMF", anmf)
+	}
+	return riffWebP(chunks), nil
+}
+
+func encodeGIF(anim *Animation) ([]byte, error) {
+	colors := append(color.Palette{}, palette.Plan9[:255]...)
+	colors = append(colors, color.Transparent)
+	g := &gif.GIF{}
+	for i, frame := range anim.Frames {
+		paletted := image.NewPaletted(frame.Bounds(), colors)
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), frame, frame.Bounds().Min)
+		g.Image = append(g.Image, paletted)
+		g.Delay = append(g.Delay, (anim.Delays[i]+5)/10)
+		g.Disposal = append(g.Disposal, gif.DisposalBackground)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := gif.EncodeAll(buf, g); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
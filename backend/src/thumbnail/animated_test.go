@@ -0,0 +1,56 @@
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+)
+
+func TestDecodeAnimatedWebPRejectsHugeCanvas(t *testing.T) {
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02
+	putUint24(vp8x[4:], 1<<24-1)
+	putUint24(vp8x[7:], 1<<24-1)
+	anmf := make([]byte, 16)
+	data := riffWebP(appendWebPChunk(appendWebPChunk(nil, "VP8X", vp8x), "ANMF", anmf))
+
+	for _, limit := range []int{0, 1} {
+		if _, err := decodeAnimatedWebP(data, DefaultOptions, limit); !errors.Is(err, errAnimationTooLarge) {
+			t.Errorf("decodeAnimatedWebP with limit %d = %v, want %v", limit, err, errAnimationTooLarge)
+		}
+	}
+}
+
+func TestDecodeAnimatedWebPRejectsFrameOutsideCanvas(t *testing.T) {
+	vp8x := make([]byte, 10)
+	vp8x[0] = 0x02
+	putUint24(vp8x[4:], 15)
+	putUint24(vp8x[7:], 15)
+	anmf := make([]byte, 16)
+	putUint24(anmf[6:], 1<<20)
+	putUint24(anmf[9:], 1<<20)
+	data := riffWebP(appendWebPChunk(appendWebPChunk(nil, "VP8X", vp8x), "ANMF", anmf))
+
+	if _, err := decodeAnimatedWebP(data, DefaultOptions, 0); err == nil {
+		t.Fatal("a frame larger than the canvas was accepted")
+	}
+}
+
+func TestDecodeGIFRejectsHugeCanvas(t *testing.T) {
+	frame := image.NewPaletted(image.Rect(0, 0, 1, 1), palette.Plan9)
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, &gif.GIF{
+		Image:  []*image.Paletted{frame, frame},
+		Delay:  []int{10, 10},
+		Config: image.Config{ColorModel: frame.Palette, Width: 65535, Height: 65535},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeGIF(buf.Bytes(), DefaultOptions); !errors.Is(err, errAnimationTooLarge) {
+		t.Fatalf("decodeGIF = %v, want %v", err, errAnimationTooLarge)
+	}
+}
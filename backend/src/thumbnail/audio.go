@@ -0,0 +1,37 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"os"
+
+	"github.com/dhowden/tag"
+	"github.com/disintegration/imaging"
+)
+
+// audioProvider shows the cover art embedded in ID3, FLAC, MP4 and Ogg tags.
+type audioProvider struct{}
+
+func (audioProvider) Available() bool {
+	return true
+}
+
+func (audioProvider) Create(filePath string, opts Options) (image.Image, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	metadata, err := tag.ReadFrom(file)
+	if err == tag.ErrNoTagsFound {
+		return nil, ErrNoThumbnail
+	}
+	if err != nil {
+		return nil, err
+	}
+	picture := metadata.Picture()
+	if picture == nil || len(picture.Data) == 0 {
+		return nil, ErrNoThumbnail
+	}
+	return imaging.Decode(bytes.NewReader(picture.Data))
+}
@@ -0,0 +1,52 @@
+package thumbnail
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// ROMExtensions are the games BoxArtProvider is registered for by default.
+// Archives and disc images are left out since they aren't always games, and so
+// is .md, which is far more often Markdown than a Mega Drive ROM (those are
+// covered by .gen and .smd).
+var ROMExtensions = []string{
+	".3ds", ".32x", ".a26", ".a78", ".cia", ".gb", ".gba", ".gbc", ".gen", ".gg",
+	".lnx", ".n64", ".nds", ".nes", ".ngc", ".ngp", ".nsp", ".pce", ".rvz", ".sfc",
+	".smc", ".smd", ".sms", ".v64", ".wbfs", ".ws", ".wsc", ".xci", ".z64",
+}
+
+var boxArtExtensions = []string{".png", ".jpg", ".jpeg"}
+
+// BoxArtProvider finds cover images for ROMs in a local folder, such as the
+// media folder of a frontend's scraper. For snes/Game.sfc it tries
+// Game.png (or .jpg) in snes/covers, snes and then the folder itself.
+type BoxArtProvider struct {
+	Dir string
+}
+
+func NewBoxArtProvider(dir string) *BoxArtProvider {
+	return &BoxArtProvider{Dir: dir}
+}
+
+func (p *BoxArtProvider) Available() bool {
+	return p.Dir != ""
+}
+
+func (p *BoxArtProvider) Create(filePath string, opts Options) (image.Image, error) {
+	name := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+	system := filepath.Base(filepath.Dir(filePath))
+	for _, dir := range []string{filepath.Join(p.Dir, system, "covers"), filepath.Join(p.Dir, system), p.Dir} {
+		for _, ext := range boxArtExtensions {
+			artPath := filepath.Join(dir, name+ext)
+			if _, err := os.Stat(artPath); err != nil {
+				continue
+			}
+			return imaging.Open(artPath)
+		}
+	}
+	return nil, ErrNoThumbnail
+}
@@ -0,0 +1,221 @@
+package thumbnail
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+)
+
+// entryOverhead is charged on top of the encoded bytes of every entry, so that
+// a folder full of failed (empty) thumbnails still counts against the budget.
+const entryOverhead = 256
+
+// errAbandoned finishes jobs that nobody was waiting for any more.
+var errAbandoned = errors.New("thumbnail no longer wanted")
+
+// CacheImageJob is a thumbnail that is either finished or still being
+// generated. Any number of callers can Wait on the same job; done is closed
+// once Data or Err is set and neither changes afterwards.
+type CacheImageJob struct {
+	Version string
+	Data    []byte
+	Err     error
+	done    chan struct{}
+	// waiters counts the requests between Join and Leave, guarded by the
+	// cache's lock
+	waiters int
+}
+
+func newCacheImageJob(version string) *CacheImageJob {
+	return &CacheImageJob{Version: version, done: make(chan struct{})}
+}
+
+func (j *CacheImageJob) Ready() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait blocks until the job is finished or ctx is done. Giving up only stops
+// this caller waiting; the generation itself carries on for everyone else.
+func (j *CacheImageJob) Wait(ctx context.Context) ([]byte, error) {
+	select {
+	case <-j.done:
+		return j.Data, j.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type cacheEntry struct {
+	key string
+	job *CacheImageJob
+}
+
+type CacheStats struct {
+	Entries  int    `json:"entries"`
+	Pending  int    `json:"pending"`
+	Bytes    int64  `json:"bytes"`
+	MaxBytes int64  `json:"maxBytes"`
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+}
+
+// Cache keeps encoded thumbnails in memory, evicting the least recently used
+// once MaxBytes is exceeded. Pending jobs are tracked separately: they hold no
+// data yet and are never evicted, so waiters can't lose their job.
+type Cache struct {
+	mu       sync.Mutex
+	MaxBytes int64
+	bytes    int64
+	lru      *list.List
+	entries  map[string]*list.Element
+	pending  map[string]*CacheImageJob
+	hits     uint64
+	misses   uint64
+}
+
+func NewCache(maxBytes int64) *Cache {
+	return &Cache{
+		MaxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+		pending:  map[string]*CacheImageJob{},
+	}
+}
+
+func (c *Cache) Lock() {
+	c.mu.Lock()
+}
+
+func (c *Cache) Unlock() {
+	c.mu.Unlock()
+}
+
+func entrySize(entry *cacheEntry) int64 {
+	return int64(len(entry.job.Data)+len(entry.key)) + entryOverhead
+}
+
+// Acquire returns the job for version (see Version) of the thumbnail at key,
+// replacing any job for another version. When there is none yet, a pending job
+// is created and owner is true: the caller must then generate the thumbnail
+// and call Complete, exactly once.
+func (m *Cache) Acquire(key string, version string) (job *CacheImageJob, owner bool) {
+	m.Lock()
+	defer m.Unlock()
+	return m.acquire(key, version)
+}
+
+// Join is Acquire for a request that is going to wait for the job, which it
+// must Leave once it stops waiting. Jobs nobody waits for can be abandoned.
+func (m *Cache) Join(key string, version string) (job *CacheImageJob, owner bool) {
+	m.Lock()
+	defer m.Unlock()
+	job, owner = m.acquire(key, version)
+	job.waiters++
+	return job, owner
+}
+
+func (m *Cache) Leave(job *CacheImageJob) {
+	m.Lock()
+	defer m.Unlock()
+	job.waiters--
+}
+
+// Abandon drops a pending job that has no waiters left, instead of completing
+// it, so that nothing is cached and it is started over when asked for again.
+// It reports whether the job was dropped; if not, it must still be completed.
+func (m *Cache) Abandon(key string, job *CacheImageJob) bool {
+	m.Lock()
+	defer m.Unlock()
+	if job.waiters > 0 || m.pending[key] != job {
+		return false
+	}
+	delete(m.pending, key)
+	job.Err = errAbandoned
+	close(job.done)
+	return true
+}
+
+func (m *Cache) acquire(key string, version string) (job *CacheImageJob, owner bool) {
+	if element, ok := m.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		if entry.job.Version == version {
+			m.lru.MoveToFront(element)
+			m.hits++
+			return entry.job, false
+		}
+		m.remove(element)
+	}
+	m.misses++
+	if job, ok := m.pending[key]; ok && job.Version == version {
+		return job, false
+	}
+	job = newCacheImageJob(version)
+	m.pending[key] = job
+	return job, true
+}
+
+// Complete finishes a job returned by Acquire and wakes every waiter. Failures
+// are cached too, so a broken file isn't retried on every listing. A job that
+// was replaced by a newer version while it ran is not cached.
+func (m *Cache) Complete(key string, job *CacheImageJob, data []byte, err error) {
+	m.Lock()
+	defer m.Unlock()
+	job.Data = data
+	job.Err = err
+	close(job.done)
+	if m.pending[key] != job {
+		return
+	}
+	delete(m.pending, key)
+	if element, ok := m.entries[key]; ok {
+		m.remove(element)
+	}
+	entry := &cacheEntry{key: key, job: job}
+	m.entries[key] = m.lru.PushFront(entry)
+	m.bytes += entrySize(entry)
+	m.evict()
+}
+
+func (m *Cache) remove(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	m.lru.Remove(element)
+	delete(m.entries, entry.key)
+	m.bytes -= entrySize(entry)
+}
+
+func (m *Cache) evict() {
+	for m.MaxBytes > 0 && m.bytes > m.MaxBytes && m.lru.Len() > 1 {
+		m.remove(m.lru.Back())
+	}
+}
+
+// Get looks up the job for key without creating one or counting towards
+// the hit rate.
+func (m *Cache) Get(key string) (*CacheImageJob, bool) {
+	m.Lock()
+	defer m.Unlock()
+	if element, ok := m.entries[key]; ok {
+		return element.Value.(*cacheEntry).job, true
+	}
+	val, ok := m.pending[key]
+	return val, ok
+}
+
+func (m *Cache) Stats() CacheStats {
+	m.Lock()
+	defer m.Unlock()
+	return CacheStats{
+		Entries:  m.lru.Len(),
+		Pending:  len(m.pending),
+		Bytes:    m.bytes,
+		MaxBytes: m.MaxBytes,
+		Hits:     m.hits,
+		Misses:   m.misses,
+	}
+}
@@ -0,0 +1,174 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheManyWaitersShareOneJob(t *testing.T) {
+	cache := NewCache(0)
+	job, owner := cache.Acquire("a", "v1")
+	if !owner {
+		t.Fatal("first Acquire should own the job")
+	}
+
+	const waiters = 50
+	var wg sync.WaitGroup
+	results := make(chan []byte, waiters)
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			waiterJob, waiterOwner := cache.Acquire("a", "v1")
+			if waiterOwner {
+				t.Error("only one caller should own the job")
+				return
+			}
+			data, err := waiterJob.Wait(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			results <- data
+		}()
+	}
+
+	cache.Complete("a", job, []byte("thumb"), nil)
+	wg.Wait()
+	close(results)
+	count := 0
+	for data := range results {
+		if !bytes.Equal(data, []byte("thumb")) {
+			t.Errorf("waiter got %q", data)
+		}
+		count++
+	}
+	if count != waiters {
+		t.Fatalf("%d waiters finished, want %d", count, waiters)
+	}
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Pending != 0 {
+		t.Fatalf("stats after Complete: %+v", stats)
+	}
+}
+
+func TestCacheCancelledWaiterDoesNotBlock(t *testing.T) {
+	cache := NewCache(0)
+	job, _ := cache.Acquire("a", "v1")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	waited := make(chan error)
+	go func() {
+		_, err := job.Wait(ctx)
+		waited <- err
+	}()
+	completed := make(chan struct{})
+	go func() {
+		cancel()
+		cache.Complete("a", job, []byte("thumb"), nil)
+		close(completed)
+	}()
+
+	select {
+	case <-completed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Complete blocked on a cancelled waiter")
+	}
+	select {
+	case err := <-waited:
+		// Either outcome is fine as long as the waiter returned
+		if err != nil && !errors.Is(err, context.Canceled) {
+			t.Fatalf("Wait returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancelled waiter never returned")
+	}
+
+	// The job finished for everyone else regardless
+	data, err := job.Wait(context.Background())
+	if err != nil || !bytes.Equal(data, []byte("thumb")) {
+		t.Fatalf("Wait after Complete = %q, %v", data, err)
+	}
+}
+
+func TestCacheErrorReachesEveryWaiter(t *testing.T) {
+	cache := NewCache(0)
+	job, _ := cache.Acquire("a", "v1")
+	failure := errors.New("broken file")
+
+	const waiters = 20
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			waiterJob, _ := cache.Acquire("a", "v1")
+			if _, err := waiterJob.Wait(context.Background()); !errors.Is(err, failure) {
+				t.Errorf("waiter got %v, want %v", err, failure)
+			}
+		}()
+	}
+	cache.Complete("a", job, nil, failure)
+	wg.Wait()
+
+	// Failures are cached so the file isn't retried straight away
+	cached, owner := cache.Acquire("a", "v1")
+	if owner || cached != job {
+		t.Fatal("failed job should be cached")
+	}
+}
+
+func TestCacheReplacedJobIsNotCached(t *testing.T) {
+	cache := NewCache(0)
+	oldJob, _ := cache.Acquire("a", "v1")
+	newJob, owner := cache.Acquire("a", "v2")
+	if !owner || newJob == oldJob {
+		t.Fatal("a new version should start a new job")
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		cache.Complete("a", oldJob, []byte("old"), nil)
+	}()
+	go func() {
+		defer wg.Done()
+		if data, err := oldJob.Wait(context.Background()); err != nil || string(data) != "old" {
+			t.Errorf("old waiter got %q, %v", data, err)
+		}
+	}()
+	wg.Wait()
+
+	if job, ok := cache.Get("a"); !ok || job != newJob {
+		t.Fatal("the replaced job took the place of the newer one")
+	}
+	cache.Complete("a", newJob, []byte("new"), nil)
+	job, owner := cache.Acquire("a", "v2")
+	if owner || job != newJob {
+		t.Fatal("the newer job should be cached")
+	}
+	if stats := cache.Stats(); stats.Entries != 1 || stats.Pending != 0 {
+		t.Fatalf("stats = %+v", stats)
+	}
+}
+
+func TestCacheAbandonOnlyWithoutWaiters(t *testing.T) {
+	cache := NewCache(0)
+	job, _ := cache.Join("a", "v1")
+	if cache.Abandon("a", job) {
+		t.Fatal("a job with a waiter was abandoned")
+	}
+	cache.Leave(job)
+	if !cache.Abandon("a", job) {
+		t.Fatal("a job without waiters should be abandoned")
+	}
+	if _, err := job.Wait(context.Background()); !errors.Is(err, errAbandoned) {
+		t.Fatalf("Wait on an abandoned job = %v", err)
+	}
+	if _, owner := cache.Acquire("a", "v1"); !owner {
+		t.Fatal("an abandoned job should be started over")
+	}
+}
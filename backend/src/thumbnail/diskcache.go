@@ -0,0 +1,128 @@
+package thumbnail
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const diskCacheExt = ".thumb"
+
+// diskCacheGeneration is part of every key, and is bumped whenever the way
+// thumbnails are made changes so that old entries are no longer used.
+const diskCacheGeneration = "2"
+
+// DiskCache stores encoded thumbnails as <dir>/<key>.thumb, where the key
+// covers the cache key (source path and Options) and Version. A changed source gets a new key, and
+// the stale entry is left for Evict. Reads refresh an entry's mtime so the
+// eviction order is least recently used.
+type DiskCache struct {
+	Dir      string
+	MaxBytes int64
+	MaxAge   time.Duration
+	mu       sync.Mutex
+}
+
+func NewDiskCache(dir string, maxBytes int64, maxAge time.Duration) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DiskCache{Dir: dir, MaxBytes: maxBytes, MaxAge: maxAge}, nil
+}
+
+func (d *DiskCache) entryPath(key string, version string) string {
+	sum := sha256.Sum256([]byte(diskCacheGeneration + "\x00" + key + "\x00" + version))
+	return filepath.Join(d.Dir, hex.EncodeToString(sum[:])+diskCacheExt)
+}
+
+func (d *DiskCache) Get(key string, version string) ([]byte, bool) {
+	entryPath := d.entryPath(key, version)
+	data, err := os.ReadFile(entryPath)
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(entryPath, now, now)
+	return data, true
+}
+
+func (d *DiskCache) Put(key string, version string, data []byte) error {
+	tmp, err := os.CreateTemp(d.Dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), d.entryPath(key, version))
+}
+
+// Evict removes entries unused for longer than MaxAge, then the least recently
+// used ones until the cache fits in MaxBytes. Zero disables either limit.
+func (d *DiskCache) Evict() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dirEntries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		log.Println("[ERROR]: Thumbnail cache eviction:", err)
+		return
+	}
+	var infos []os.FileInfo
+	var total int64
+	for _, entry := range dirEntries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), "tmp-") && time.Since(info.ModTime()) > time.Hour {
+			os.Remove(filepath.Join(d.Dir, info.Name()))
+			continue
+		}
+		if !strings.HasSuffix(info.Name(), diskCacheExt) {
+			continue
+		}
+		infos = append(infos, info)
+		total += info.Size()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+	removed := 0
+	for _, info := range infos {
+		expired := d.MaxAge > 0 && time.Since(info.ModTime()) > d.MaxAge
+		oversize := d.MaxBytes > 0 && total > d.MaxBytes
+		if !expired && !oversize {
+			break
+		}
+		if err := os.Remove(filepath.Join(d.Dir, info.Name())); err != nil {
+			log.Println("[ERROR]: Thumbnail cache eviction:", err)
+			continue
+		}
+		total -= info.Size()
+		removed++
+	}
+	if removed > 0 {
+		log.Println("[INFO]: Thumbnail cache eviction: removed", removed, "entries")
+	}
+}
+
+func (d *DiskCache) RunEvictor(interval time.Duration) {
+	d.Evict()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.Evict()
+	}
+}
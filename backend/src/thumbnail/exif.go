@@ -0,0 +1,91 @@
+package thumbnail
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+var ErrNotAnImage = errors.New("not an image")
+
+// ImageMetadata is what the detail panel shows for a photo. Width and Height
+// are as displayed, after applying Orientation.
+type ImageMetadata struct {
+	Width       int        `json:"width"`
+	Height      int        `json:"height"`
+	Format      string     `json:"format"`
+	Orientation int        `json:"orientation,omitempty"`
+	CaptureTime *time.Time `json:"captureTime,omitempty"`
+	CameraMake  string     `json:"cameraMake,omitempty"`
+	CameraModel string     `json:"cameraModel,omitempty"`
+	Latitude    *float64   `json:"latitude,omitempty"`
+	Longitude   *float64   `json:"longitude,omitempty"`
+}
+
+// ReadImageMetadata reads the dimensions and EXIF data of an image. Location
+// is left out unless includeGPS is set, since photos are often shared without
+// realising they carry it.
+func ReadImageMetadata(filePath string, includeGPS bool) (ImageMetadata, error) {
+	var meta ImageMetadata
+	file, err := os.Open(filePath)
+	if err != nil {
+		return meta, err
+	}
+	defer file.Close()
+	config, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return meta, ErrNotAnImage
+	}
+	meta.Width, meta.Height, meta.Format = config.Width, config.Height, format
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return meta, err
+	}
+	x, err := exif.Decode(file)
+	if err != nil {
+		return meta, nil
+	}
+	if tag, err := x.Get(exif.Orientation); err == nil {
+		if orientation, err := tag.Int(0); err == nil {
+			meta.Orientation = orientation
+		}
+	}
+	if meta.Orientation >= 5 && meta.Orientation <= 8 {
+		meta.Width, meta.Height = meta.Height, meta.Width
+	}
+	if captureTime, err := x.DateTime(); err == nil {
+		meta.CaptureTime = &captureTime
+	}
+	meta.CameraMake = exifString(x, exif.Make)
+	meta.CameraModel = exifString(x, exif.Model)
+	if includeGPS {
+		if lat, long, err := x.LatLong(); err == nil {
+			meta.Latitude, meta.Longitude = &lat, &long
+		}
+	}
+	return meta, nil
+}
+
+func (m ImageMetadata) Location() string {
+	if m.Latitude == nil || m.Longitude == nil {
+		return ""
+	}
+	return fmt.Sprintf("%.5f, %.5f", *m.Latitude, *m.Longitude)
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	value, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(value, "\x00"))
+}
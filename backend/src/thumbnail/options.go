@@ -0,0 +1,138 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/disintegration/imaging"
+)
+
+type SizeClass string
+
+const (
+	SizeSmall  SizeClass = "small"
+	SizeMedium SizeClass = "medium"
+	SizeLarge  SizeClass = "large"
+)
+
+const (
+	FilterFast    = "fast"
+	FilterQuality = "quality"
+)
+
+// sizePixels is the longest edge for each size class. Small and medium are
+// cropped to a square for the list and grid, large keeps its aspect ratio for
+// the lightbox.
+var sizePixels = map[SizeClass]int{
+	SizeSmall:  128,
+	SizeMedium: 320,
+	SizeLarge:  1280,
+}
+
+type Options struct {
+	Size     SizeClass
+	Filter   string
+	WebP     bool
+	Sprite   bool
+	Animated bool
+}
+
+// DefaultOptions is what the folder listing shows, and what batch jobs
+// generate ahead of time.
+var DefaultOptions = Options{Size: SizeSmall, Filter: FilterFast, WebP: true}
+
+// ParseOptions reads the size, filter, sprite and animated query params and
+// whether the client accepts WebP. Unknown values fall back to the defaults;
+// the filter defaults to fast for small thumbnails and quality for the bigger
+// ones.
+func ParseOptions(query url.Values, accept string) Options {
+	opts := Options{
+		Size:   SizeClass(query.Get("size")),
+		Filter: query.Get("filter"),
+		WebP:   strings.Contains(accept, "image/webp"),
+		Sprite: query.Get("sprite") == "true",
+	}
+	opts.Animated = query.Get("animated") == "true" && !opts.Sprite
+	if _, ok := sizePixels[opts.Size]; !ok || opts.Sprite {
+		opts.Size = SizeSmall
+	}
+	if opts.Filter != FilterFast && opts.Filter != FilterQuality {
+		opts.Filter = FilterQuality
+		if opts.Size == SizeSmall {
+			opts.Filter = FilterFast
+		}
+	}
+	return opts
+}
+
+// Key identifies the variant, for cache keys and ETags.
+func (o Options) Key() string {
+	key := string(o.Size) + "-" + o.Filter
+	if o.WebP {
+		key += "-webp"
+	}
+	if o.Sprite {
+		key += "-sprite"
+	}
+	if o.Animated {
+		key += "-animated"
+	}
+	return key
+}
+
+// Pixels is the longest edge of the thumbnail.
+func (o Options) Pixels() int {
+	return sizePixels[o.Size]
+}
+
+func (o Options) resampleFilter() imaging.ResampleFilter {
+	if o.Filter == FilterQuality {
+		return imaging.Lanczos
+	}
+	return imaging.NearestNeighbor
+}
+
+func (o Options) resize(src image.Image) image.Image {
+	pixels := o.Pixels()
+	if o.Size == SizeLarge {
+		return imaging.Fit(src, pixels, pixels, o.resampleFilter())
+	}
+	return imaging.Thumbnail(src, pixels, pixels, o.resampleFilter())
+}
+
+// encode keeps transparency as WebP (or PNG for clients without WebP) and
+// uses JPEG for everything else. The WebP encoder is lossless only, which is
+// much bigger than JPEG for photos, so opaque images don't use it.
+func (o Options) encode(img image.Image) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	var err error
+	switch {
+	case isOpaque(img):
+		err = imaging.Encode(buf, img, imaging.JPEG)
+	case o.WebP:
+		err = nativewebp.Encode(buf, img, nil)
+	default:
+		err = imaging.Encode(buf, img, imaging.PNG)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func isOpaque(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return opaque.Opaque()
+	}
+	return true
+}
+
+// ContentType sniffs the format of an encoded thumbnail, which depends on the
+// source image as well as the Options it was made with.
+func ContentType(data []byte) string {
+	return http.DetectContentType(data)
+}
@@ -0,0 +1,43 @@
+package thumbnail
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"log"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+const pdfTimeout = 30 * time.Second
+
+var pdftoppmAvailable = sync.OnceValue(func() bool {
+	if _, err := exec.LookPath("pdftoppm"); err != nil {
+		log.Println("[INFO]: pdftoppm not found, PDF thumbnails are disabled")
+		return false
+	}
+	return true
+})
+
+// pdfProvider renders the first page with pdftoppm, from poppler-utils.
+type pdfProvider struct{}
+
+func (pdfProvider) Available() bool {
+	return pdftoppmAvailable()
+}
+
+func (pdfProvider) Create(filePath string, opts Options) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pdfTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "pdftoppm", "-f", "1", "-l", "1", "-singlefile",
+		"-scale-to", strconv.Itoa(opts.Pixels()), "-jpeg", filePath)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	return imaging.Decode(bytes.NewReader(output))
+}
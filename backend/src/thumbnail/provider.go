@@ -0,0 +1,97 @@
+package thumbnail
+
+import (
+	"errors"
+	"image"
+	"mime"
+	"path"
+	"strings"
+	"sync"
+)
+
+// ErrNoThumbnail is returned by providers for files of a type they handle
+// that simply have nothing to show, like a song without cover art. It isn't
+// logged as an error.
+var ErrNoThumbnail = errors.New("file has no thumbnail")
+
+// Provider makes the source image for a thumbnail. The generator resizes and
+// encodes it, so it can be any size, though providers that can cheaply make
+// something close to opts.Pixels() should.
+type Provider interface {
+	// Available reports whether the provider can run at all, e.g. whether
+	// the tool it needs is installed.
+	Available() bool
+	Create(filePath string, opts Options) (image.Image, error)
+}
+
+// Registry picks the Provider for a file. Providers registered for an
+// extension win over ones registered for its mime type, and an exact mime type
+// wins over a wildcard like "audio/*".
+type Registry struct {
+	mu         sync.RWMutex
+	extensions map[string]Provider
+	mimeTypes  map[string]Provider
+}
+
+func NewRegistry() *Registry {
+	return &Registry{extensions: map[string]Provider{}, mimeTypes: map[string]Provider{}}
+}
+
+// DefaultRegistry has the providers that need no configuration.
+func DefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.RegisterMimeType(imageProvider{}, "image/*")
+	r.RegisterExtension(svgProvider{}, ".svg")
+	r.RegisterMimeType(NewVideoProvider(0), "video/*")
+	r.RegisterMimeType(audioProvider{}, "audio/*")
+	r.RegisterExtension(audioProvider{}, ".flac", ".m4a", ".mp3", ".ogg", ".opus")
+	r.RegisterMimeType(pdfProvider{}, "application/pdf")
+	r.RegisterMimeType(textProvider{}, "text/*", "application/json", "application/xml")
+	r.RegisterExtension(textProvider{}, ".cfg", ".conf", ".ini", ".log", ".md", ".toml", ".yaml", ".yml")
+	return r
+}
+
+func (r *Registry) RegisterExtension(provider Provider, extensions ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, ext := range extensions {
+		r.extensions[strings.ToLower(ext)] = provider
+	}
+}
+
+func (r *Registry) RegisterMimeType(provider Provider, mimeTypes ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, mimeType := range mimeTypes {
+		r.mimeTypes[mimeType] = provider
+	}
+}
+
+// Lookup returns the provider for filePath, if there is one and it is
+// available.
+func (r *Registry) Lookup(filePath string) (Provider, bool) {
+	r.mu.RLock()
+	provider, ok := r.lookup(filePath)
+	r.mu.RUnlock()
+	if !ok || !provider.Available() {
+		return nil, false
+	}
+	return provider, true
+}
+
+func (r *Registry) lookup(filePath string) (Provider, bool) {
+	ext := strings.ToLower(path.Ext(filePath))
+	if provider, ok := r.extensions[ext]; ok {
+		return provider, true
+	}
+	mimeType, _, _ := strings.Cut(mime.TypeByExtension(ext), ";")
+	if mimeType == "" {
+		return nil, false
+	}
+	if provider, ok := r.mimeTypes[mimeType]; ok {
+		return provider, true
+	}
+	major, _, _ := strings.Cut(mimeType, "/")
+	provider, ok := r.mimeTypes[major+"/*"]
+	return provider, ok
+}
@@ -0,0 +1,81 @@
+package thumbnail
+
+import (
+	"sync"
+)
+
+type queueItem struct {
+	path string
+	opts Options
+	job  *CacheImageJob
+}
+
+// workQueue hands paths to the workers. Requested thumbnails always go before
+// the batch for the folder being listed, and starting a new batch drops
+// whatever is left of the previous one.
+type workQueue struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	requested []queueItem
+	batch     []string
+	// listed is every path in the folder being listed, whether it is in the
+	// batch or not
+	listed map[string]bool
+}
+
+func newWorkQueue() *workQueue {
+	q := &workQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// pushRequested queues a job the caller already owns, see Cache.Acquire.
+func (q *workQueue) pushRequested(filePath string, opts Options, job *CacheImageJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.requested = append(q.requested, queueItem{path: filePath, opts: opts, job: job})
+	q.cond.Signal()
+}
+
+func (q *workQueue) replaceBatch(paths []string, listed []string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	dropped := len(q.batch)
+	q.batch = paths
+	q.listed = make(map[string]bool, len(listed))
+	for _, p := range listed {
+		q.listed[p] = true
+	}
+	q.cond.Broadcast()
+	return dropped
+}
+
+// requeueAbandoned puts a requested item whose requests all gave up back in
+// the batch, ahead of the rest, if it is in the folder being listed. Anything
+// else was left behind and is dropped.
+func (q *workQueue) requeueAbandoned(item queueItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.listed[item.path] && item.opts == DefaultOptions {
+		q.batch = append([]string{item.path}, q.batch...)
+	}
+}
+
+// pop blocks until there is work. Batch items use DefaultOptions and are
+// returned without a job; the worker acquires one when it gets to them.
+func (q *workQueue) pop() queueItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.requested) == 0 && len(q.batch) == 0 {
+		q.cond.Wait()
+	}
+	if len(q.requested) > 0 {
+		item := q.requested[0]
+		q.requested[0] = queueItem{}
+		q.requested = q.requested[1:]
+		return item
+	}
+	item := queueItem{path: q.batch[0], opts: DefaultOptions}
+	q.batch = q.batch[1:]
+	return item
+}
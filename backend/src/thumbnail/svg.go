@@ -0,0 +1,41 @@
+package thumbnail
+
+import (
+	"fmt"
+	"image"
+	"os"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+type svgProvider struct{}
+
+func (svgProvider) Available() bool {
+	return true
+}
+
+// Create rasterises the drawing with its longest edge at opts.Pixels(),
+// leaving the background transparent.
+func (svgProvider) Create(filePath string, opts Options) (image.Image, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	icon, err := oksvg.ReadIconStream(file, oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	viewWidth, viewHeight := icon.ViewBox.W, icon.ViewBox.H
+	if viewWidth <= 0 || viewHeight <= 0 {
+		return nil, fmt.Errorf("no size in %s", filePath)
+	}
+	scale := float64(opts.Pixels()) / max(viewWidth, viewHeight)
+	width, height := max(1, int(viewWidth*scale)), max(1, int(viewHeight*scale))
+	icon.SetTarget(0, 0, float64(width), float64(height))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	scanner := rasterx.NewScannerGV(width, height, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(width, height, scanner), 1)
+	return img, nil
+}
@@ -0,0 +1,69 @@
+package thumbnail
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// textSnippetBytes is how much of a text file is read. It is more than fits
+// on even the large size.
+const textSnippetBytes = 8 << 10
+
+// textProvider draws the start of a text file. Files that turn out to be
+// binary have no thumbnail.
+type textProvider struct{}
+
+func (textProvider) Available() bool {
+	return true
+}
+
+func (textProvider) Create(filePath string, opts Options) (image.Image, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	buf := make([]byte, textSnippetBytes)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	buf = buf[:n]
+	if n == 0 || bytes.IndexByte(buf, 0) >= 0 {
+		return nil, ErrNoThumbnail
+	}
+	// The snippet may end halfway through a character
+	for i := 0; i < utf8.UTFMax && !utf8.Valid(buf); i++ {
+		buf = buf[:len(buf)-1]
+	}
+	if !utf8.Valid(buf) {
+		return nil, ErrNoThumbnail
+	}
+
+	face := basicfont.Face7x13
+	size := min(opts.Pixels(), 512)
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	drawer := font.Drawer{Dst: img, Src: image.NewUniform(color.Gray{Y: 0x30}), Face: face}
+	lineHeight := face.Ascent + face.Descent
+	y := 4 + face.Ascent
+	for _, line := range strings.Split(string(buf), "\n") {
+		if y > size {
+			break
+		}
+		drawer.Dot = fixed.P(4, y)
+		drawer.DrawString(strings.ReplaceAll(strings.TrimRight(line, "\r"), "\t", "    "))
+		y += lineHeight
+	}
+	return img, nil
+}
@@ -1,234 +1,277 @@
 package thumbnail
 
 import (
-	"bytes"
 	"context"
 	"embed"
 	"errors"
+	"fmt"
 	"image"
 	"log"
 	"mime"
+	"os"
 	"path"
+	"runtime"
 	"strings"
 	"sync"
 
 	"github.com/disintegration/imaging"
-	ffmpeg "github.com/u2takey/ffmpeg-go"
 )
 
 //go:embed static/*
 var staticFS embed.FS
 
-type CacheImageJob struct {
-	Image image.Image
-	Ready bool
-}
-
-type Cache struct {
-	mu     sync.Mutex
-	Images map[string]*CacheImageJob
-	Chans  map[string]chan *CacheImageJob
+type ThumbnailGenerator struct {
+	ThumbnailDir string
+	Cache        *Cache
+	Disk         *DiskCache
+	Sprites      SpriteLayout
+	Providers    *Registry
+	queue        *workQueue
+	mu           sync.Mutex
+	workers      int
 }
 
-func (c *Cache) Lock() {
-	c.mu.Lock()
+func NewThumbnailGenerator(cache *Cache) *ThumbnailGenerator {
+	return &ThumbnailGenerator{Cache: cache, Providers: DefaultRegistry(), queue: newWorkQueue()}
 }
 
-func (c *Cache) Unlock() {
-	c.mu.Unlock()
+// DefaultWorkerCount leaves half the CPU for the rest of the system, which
+// on the Steam Deck is usually a game.
+func DefaultWorkerCount() int {
+	return max(1, runtime.NumCPU()/2)
 }
 
-func (m *Cache) Add(filePath string, img image.Image) {
-	m.Lock()
-	defer m.Unlock()
-	val, ok := m.Images[filePath]
-	if ok && val.Ready {
-		return
-	}
-	if ok {
-		val.Image = img
-		val.Ready = true
-	} else {
-		m.Images[filePath] = &CacheImageJob{Image: img, Ready: true}
-	}
-	pendingChan, exists := m.Chans[filePath]
-	if exists {
-		pendingChan <- val
+// SetWorkerCount starts or stops workers until count are running. A count of
+// zero or less uses DefaultWorkerCount. Surplus workers exit after finishing
+// their current thumbnail.
+func (tg *ThumbnailGenerator) SetWorkerCount(count int) {
+	if count <= 0 {
+		count = DefaultWorkerCount()
 	}
-	m.Chans[filePath] = nil
-}
-
-func (m *Cache) AddPendingJob(filePath string) {
-	m.Lock()
-	defer m.Unlock()
-	_, ok := m.Images[filePath]
-	if !ok {
-		m.Images[filePath] = &CacheImageJob{Ready: false}
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	for i := tg.workers; i < count; i++ {
+		go tg.work(i)
 	}
+	tg.workers = count
 }
 
-func (m *Cache) Get(filePath string) (*CacheImageJob, bool) {
-	m.Lock()
-	defer m.Unlock()
-	val, ok := m.Images[filePath]
-	return val, ok
+func (tg *ThumbnailGenerator) keepWorking(workerId int) bool {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	return workerId < tg.workers
 }
 
-func (m *Cache) AddChan(filePath string, waitChan chan *CacheImageJob) {
-	m.Lock()
-	defer m.Unlock()
-	_, exists := m.Chans[filePath]
-	if !exists {
-		m.Chans[filePath] = waitChan
+func (tg *ThumbnailGenerator) work(workerId int) {
+	for tg.keepWorking(workerId) {
+		item := tg.queue.pop()
+		// The browser cancels the requests for thumbnails of a folder that
+		// was left, which shouldn't hold up the next one
+		if item.job != nil && tg.Cache.Abandon(cacheKey(item.path, item.opts), item.job) {
+			tg.queue.requeueAbandoned(item)
+			continue
+		}
+		imageJob, owner := item.job, item.job != nil
+		if !owner {
+			version, err := SourceVersion(item.path)
+			if err != nil {
+				continue
+			}
+			imageJob, owner = tg.Cache.Acquire(cacheKey(item.path, item.opts), version)
+		}
+		if !owner {
+			continue
+		}
+		if err := tg.run(item.path, item.opts, imageJob); err != nil && !errors.Is(err, ErrNoThumbnail) {
+			log.Println("[ERROR]: work => Error: ", workerId, item.path, err)
+		}
 	}
 }
 
-type ThumbnailGenerator struct {
-	ThumbnailDir string
-	Cache        Cache
-	jobs         chan string
-	cancelWork   context.CancelFunc
+func (tg *ThumbnailGenerator) run(filePath string, opts Options, imageJob *CacheImageJob) (err error) {
+	var data []byte
+	defer func() {
+		// A malformed file must not take the whole server down with it
+		if r := recover(); r != nil {
+			data, err = nil, fmt.Errorf("panic while generating thumbnail: %v", r)
+		}
+		tg.Cache.Complete(cacheKey(filePath, opts), imageJob, data, err)
+	}()
+	data, err = tg.GenerateThumbnail(filePath, imageJob.Version, opts)
+	return err
 }
 
-func (tg *ThumbnailGenerator) SetWorkerCount(count int) {
-	tg.jobs = make(chan string, count)
-	for i := 0; i < count; i++ {
-		go tg.work(i, tg.jobs)
-	}
+func cacheKey(filePath string, opts Options) string {
+	return filePath + "#" + opts.Key()
 }
 
-func (tg *ThumbnailGenerator) work(workerId int, jobs <-chan string) {
-	for j := range jobs {
-		imageJob, exists := tg.Cache.Get(j)
-		if exists && imageJob.Ready {
+// StartBatchJob queues thumbnails for a folder that is being listed. Anything
+// still queued from the previous folder is dropped.
+func (tg *ThumbnailGenerator) StartBatchJob(paths []string) {
+	batch := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if !tg.IsCompatibleType(p) {
 			continue
 		}
-		_, err := tg.GenerateThumbnail(j)
-		if err != nil {
-			log.Println("[ERROR]: work => Error: ", workerId, j, err)
+		if _, exists := tg.Cache.Get(cacheKey(p, DefaultOptions)); exists {
+			continue
 		}
+		batch = append(batch, p)
+	}
+	if dropped := tg.queue.replaceBatch(batch, paths); dropped > 0 {
+		log.Println("[INFO]: StartBatchJob => dropped", dropped, "thumbnails from the previous folder")
 	}
 }
 
-func (tg *ThumbnailGenerator) StartBatchJob(paths []string) {
-	if tg.cancelWork != nil {
-		tg.cancelWork()
+// IsReady reports whether the thumbnail for filePath has been generated.
+func (tg *ThumbnailGenerator) IsReady(filePath string, opts Options) bool {
+	imageJob, ok := tg.Cache.Get(cacheKey(filePath, opts))
+	return ok && imageJob.Ready()
+}
+
+type imageProvider struct{}
+
+func (imageProvider) Available() bool {
+	return true
+}
+
+// Create falls back to the first frame for animated WebPs, which
+// golang.org/x/image can't decode.
+func (p imageProvider) Create(filePath string, opts Options) (image.Image, error) {
+	img, err := imaging.Open(filePath, imaging.AutoOrientation(true))
+	if err == nil || !strings.EqualFold(path.Ext(filePath), ".webp") {
+		return img, err
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	tg.cancelWork = cancel
-	for _, p := range paths {
-		if !tg.IsCompatibleType(p) {
-			continue
-		}
-		select {
-		case <-ctx.Done():
-			break
-		case tg.jobs <- p:
-			break
-		}
+	data, readErr := os.ReadFile(filePath)
+	if readErr != nil || len(data) < 12 {
+		return nil, err
+	}
+	anim, animErr := decodeAnimatedWebP(data, opts, 1)
+	if animErr != nil {
+		return nil, err
 	}
+	return anim.Frames[0], nil
 }
 
-func (tg *ThumbnailGenerator) CreateImageThumbnail(filePath string) (*image.NRGBA, error) {
-	src, err := imaging.Open(filePath)
+func (imageProvider) CreateAnimation(filePath string, opts Options) (*Animation, error) {
+	data, err := os.ReadFile(filePath)
 	if err != nil {
-		log.Println("[ERROR]: CreateImageThumbnail => imaging.Open()", filePath, err.Error())
 		return nil, err
 	}
-	// resized := imaging.Resize(src, 128, 0, imaging.NearestNeighbor)
-	resized := imaging.Thumbnail(src, 128, 128, imaging.NearestNeighbor)
-	return resized, err
+	return decodeAnimation(data, opts)
 }
 
-func (tg *ThumbnailGenerator) CreateVideoThumbnail(filePath string) (image.Image, error) {
-	buf := bytes.NewBuffer(nil)
-	err := ffmpeg.Input(filePath).
-		Filter("scale", ffmpeg.Args{"128:-1"}).
-		Filter("select", ffmpeg.Args{"gte(n,0)"}).
-		Output("pipe:", ffmpeg.KwArgs{"vframes": 1, "format": "image2", "vcodec": "mjpeg", "qscale": 20}).
-		WithOutput(buf).
-		Run()
+// GetThumbnail returns the cached thumbnail, waiting for it if a worker or
+// another request is already generating it and queueing it ahead of any batch
+// otherwise.
+func (tg *ThumbnailGenerator) GetThumbnail(filePath string, opts Options, requestContext context.Context) ([]byte, error) {
+	version, err := SourceVersion(filePath)
 	if err != nil {
-		log.Println("[ERROR]: ThumbnailGenerator => CreateVideoThumbnail => ffmpeg.Run()", filePath, err)
 		return nil, err
 	}
-	img, error := imaging.Decode(buf)
-	if error != nil {
-		log.Println("[ERROR]: ThumbnailGenerator => CreateVideoThumbnail => imaging.Decode()", filePath, error)
+	imageJob, owner := tg.Cache.Join(cacheKey(filePath, opts), version)
+	defer tg.Cache.Leave(imageJob)
+	if owner {
+		tg.queue.pushRequested(filePath, opts, imageJob)
 	}
-	return img, error
+	return imageJob.Wait(requestContext)
 }
 
-func (m *Cache) WaitForThumbnail(filePath string, requestContext context.Context) (image.Image, error) {
-	imageJob, ok := m.Get(filePath)
-	if ok {
-		if imageJob.Ready {
-			return imageJob.Image, nil
-		}
-		waitChan, _ := m.Chans[filePath]
-		if waitChan == nil {
-			waitChan = make(chan *CacheImageJob)
-		}
-		m.AddChan(filePath, waitChan)
-		select {
-		case result := <-waitChan:
-			return result.Image, nil
-		case <-requestContext.Done():
-		}
+// Version identifies the contents of a source file for caching, changing
+// whenever its size or mtime does.
+func Version(info os.FileInfo) string {
+	return fmt.Sprintf("%x-%x", info.Size(), info.ModTime().UnixNano())
+}
+
+func SourceVersion(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
 	}
-	return nil, errors.New("Problem waiting for thumbnail")
+	return Version(info), nil
 }
 
-func (tg *ThumbnailGenerator) GetThumbnail(filePath string, requestContext context.Context) (image.Image, error) {
-	imageJob, ok := tg.Cache.Get(filePath)
-	if ok {
-		if !imageJob.Ready {
-			img, err := tg.Cache.WaitForThumbnail(filePath, requestContext)
-			if err != nil {
-				log.Println("[ERROR]: GetThumbnail => WaitForThumbnail()", filePath, err)
-			}
-			return img, err
+// GenerateThumbnail creates the encoded thumbnail for filePath, using the disk
+// cache when possible. It doesn't touch the memory cache.
+func (tg *ThumbnailGenerator) GenerateThumbnail(filePath string, version string, opts Options) ([]byte, error) {
+	key := cacheKey(filePath, opts)
+	if tg.Disk != nil {
+		if data, ok := tg.Disk.Get(key, version); ok {
+			return data, nil
+		}
+	}
+	var img image.Image
+	var err error
+	if opts.Sprite {
+		if !tg.HasSprite(filePath) {
+			return nil, errors.New("Request to generate sprite sheet but not video")
 		}
-		return imageJob.Image, nil
+		img, err = tg.CreateVideoSprite(filePath, tg.Sprites)
 	} else {
-		tg.Cache.AddPendingJob(filePath)
-		img, err := tg.Cache.WaitForThumbnail(filePath, requestContext)
-		if err != nil {
-			log.Println("[ERROR]: GetThumbnail => WaitForThumbnail()", filePath, err)
+		provider, ok := tg.Providers.Lookup(filePath)
+		if !ok {
+			return nil, errors.New("Request to generate thumbnail but no provider for file type")
 		}
-		return img, err
+		if animator, ok := provider.(Animator); ok && opts.Animated {
+			data, err := tg.generateAnimation(filePath, animator, opts)
+			if !errors.Is(err, ErrNotAnimated) {
+				return tg.store(filePath, key, version, data, err)
+			}
+		}
+		img, err = provider.Create(filePath, opts)
+		if err == nil {
+			img = opts.resize(img)
+		}
+	}
+	if errors.Is(err, ErrNoThumbnail) {
+		return nil, err
+	}
+	if err != nil {
+		log.Println("[ERROR]: GenerateThumbnail => Create()", filePath, err)
+		return nil, err
 	}
+	data, err := opts.encode(img)
+	if err != nil {
+		log.Println("[ERROR]: GenerateThumbnail => encode()", filePath, err)
+	}
+	return tg.store(filePath, key, version, data, err)
 }
 
-func (tg *ThumbnailGenerator) GenerateThumbnail(filePath string) (image.Image, error) {
-	tg.Cache.AddPendingJob(filePath)
-	ext := mime.TypeByExtension(path.Ext(filePath))
-	if strings.HasPrefix(ext, "image") {
-		img, err := tg.CreateImageThumbnail(filePath)
-		if err != nil {
-			img = nil
-			log.Println("[ERROR]: GenerateThumbnail => CreateImageThumbnail()", filePath, img, err)
-			tg.Cache.Add(filePath, nil)
-		}
-		if img != nil {
-			tg.Cache.Add(filePath, img)
-		}
-		return img, err
-	} else if strings.HasPrefix(ext, "video") {
-		img, err := tg.CreateVideoThumbnail(filePath)
-		if err != nil {
-			log.Println("[ERROR]: GenerateThumbnail => CreateVideoThumbnail()", filePath, img, err)
-			tg.Cache.Add(filePath, nil)
+func (tg *ThumbnailGenerator) generateAnimation(filePath string, animator Animator, opts Options) ([]byte, error) {
+	anim, err := animator.CreateAnimation(filePath, opts)
+	if err != nil {
+		if !errors.Is(err, ErrNotAnimated) {
+			log.Println("[ERROR]: GenerateThumbnail => CreateAnimation()", filePath, err)
 		}
-		if img != nil {
-			tg.Cache.Add(filePath, img)
+		return nil, err
+	}
+	data, err := opts.encodeAnimation(anim)
+	if err != nil {
+		log.Println("[ERROR]: GenerateThumbnail => encodeAnimation()", filePath, err)
+	}
+	return data, err
+}
+
+// store saves a newly generated thumbnail to the disk cache.
+func (tg *ThumbnailGenerator) store(filePath, key, version string, data []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	if tg.Disk != nil {
+		if err := tg.Disk.Put(key, version, data); err != nil {
+			log.Println("[ERROR]: GenerateThumbnail => Disk.Put()", filePath, err)
 		}
-		return img, err
 	}
-	return nil, errors.New("Request to generate thumbnail but not image/video")
+	return data, nil
 }
 
 func (tg *ThumbnailGenerator) IsCompatibleType(filePath string) bool {
+	_, ok := tg.Providers.Lookup(filePath)
+	return ok
+}
+
+// HasSprite reports whether a sprite sheet can be made for filePath.
+func (tg *ThumbnailGenerator) HasSprite(filePath string) bool {
 	mimeType := mime.TypeByExtension(path.Ext(filePath))
-	return strings.HasPrefix(mimeType, "image") || strings.HasPrefix(mimeType, "video")
+	return tg.Sprites.Frames > 0 && strings.HasPrefix(mimeType, "video") && ffmpegAvailable()
 }
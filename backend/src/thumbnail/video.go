@@ -0,0 +1,184 @@
+package thumbnail
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+var ErrNoFFmpeg = errors.New("ffmpeg is not installed")
+
+// frameOffset is how far into a video its thumbnail is taken from. Game
+// recordings usually start on a black or loading screen.
+const frameOffset = 0.1
+
+const probeTimeout = 10 * time.Second
+
+// ffmpegAvailable checks for ffmpeg once, so that a missing install turns video
+// thumbnails off instead of failing (and logging) once per file.
+var ffmpegAvailable = sync.OnceValue(func() bool {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		log.Println("[INFO]: ffmpeg not found, video thumbnails are disabled")
+		return false
+	}
+	return true
+})
+
+var ffprobeAvailable = sync.OnceValue(func() bool {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		log.Println("[INFO]: ffprobe not found, video thumbnails will use the first frame")
+		return false
+	}
+	return true
+})
+
+type probeResult struct {
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+// probeDuration returns the length of a video in seconds, or 0 when it can't
+// be found.
+func probeDuration(filePath string) float64 {
+	if !ffprobeAvailable() {
+		return 0
+	}
+	output, err := ffmpeg.ProbeWithTimeout(filePath, probeTimeout, nil)
+	if err != nil {
+		log.Println("[ERROR]: ThumbnailGenerator => probeDuration => ffmpeg.Probe()", filePath, err)
+		return 0
+	}
+	var result probeResult
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		return 0
+	}
+	duration, err := strconv.ParseFloat(result.Format.Duration, 64)
+	if err != nil || duration < 0 {
+		return 0
+	}
+	return duration
+}
+
+// grabFrame decodes the frame at the given time, scaled so that its shorter
+// edge is at least pixels.
+func grabFrame(filePath string, at float64, pixels int) (image.Image, error) {
+	buf := bytes.NewBuffer(nil)
+	err := ffmpeg.Input(filePath, ffmpeg.KwArgs{"ss": fmt.Sprintf("%.3f", at)}).
+		Filter("scale", ffmpeg.Args{fmt.Sprintf("%d:%d:force_original_aspect_ratio=increase", pixels, pixels)}).
+		Output("pipe:", ffmpeg.KwArgs{"vframes": 1, "format": "image2", "vcodec": "mjpeg", "qscale": 2}).
+		WithOutput(buf).
+		Run()
+	if err != nil {
+		return nil, err
+	}
+	if buf.Len() == 0 {
+		return nil, fmt.Errorf("no frame at %.3fs", at)
+	}
+	return imaging.Decode(buf)
+}
+
+// clipFPS is the frame rate of animated video thumbnails.
+const clipFPS = 10
+
+// VideoProvider takes a frame from a little way into the video. For animated
+// thumbnails it takes ClipSeconds from the same point instead, or none if
+// ClipSeconds is 0.
+type VideoProvider struct {
+	ClipSeconds float64
+}
+
+func NewVideoProvider(clipSeconds float64) *VideoProvider {
+	return &VideoProvider{ClipSeconds: clipSeconds}
+}
+
+func (p *VideoProvider) Available() bool {
+	return ffmpegAvailable()
+}
+
+func (p *VideoProvider) Create(filePath string, opts Options) (image.Image, error) {
+	return grabFrame(filePath, probeDuration(filePath)*frameOffset, opts.Pixels())
+}
+
+func (p *VideoProvider) CreateAnimation(filePath string, opts Options) (*Animation, error) {
+	if p.ClipSeconds <= 0 {
+		return nil, ErrNotAnimated
+	}
+	pixels := opts.Pixels()
+	buf := bytes.NewBuffer(nil)
+	err := ffmpeg.Input(filePath, ffmpeg.KwArgs{"ss": fmt.Sprintf("%.3f", probeDuration(filePath)*frameOffset)}).
+		Output("pipe:", ffmpeg.KwArgs{
+			"t":              fmt.Sprintf("%.3f", p.ClipSeconds),
+			"filter_complex": fmt.Sprintf("fps=%d,scale=%d:%d:force_original_aspect_ratio=increase,split[a][b];[a]palettegen[p];[b][p]paletteuse", clipFPS, pixels, pixels),
+			"format":         "gif",
+		}).
+		WithOutput(buf).
+		Run()
+	if err != nil {
+		return nil, err
+	}
+	return decodeGIF(buf.Bytes(), opts)
+}
+
+// SpriteLayout describes a sprite sheet: Frames square frames, evenly spaced
+// through the video, laid out left to right and then top to bottom.
+type SpriteLayout struct {
+	Frames    int `json:"frames"`
+	Columns   int `json:"columns"`
+	Rows      int `json:"rows"`
+	FrameSize int `json:"frameSize"`
+}
+
+func NewSpriteLayout(frames int) SpriteLayout {
+	columns := min(frames, 10)
+	return SpriteLayout{
+		Frames:    frames,
+		Columns:   columns,
+		Rows:      (frames + columns - 1) / columns,
+		FrameSize: sizePixels[SizeSmall],
+	}
+}
+
+// CreateVideoSprite seeks to each frame separately rather than decoding the
+// whole video, which keeps long recordings fast. Frames that can't be read
+// are left black.
+func (tg *ThumbnailGenerator) CreateVideoSprite(filePath string, layout SpriteLayout) (image.Image, error) {
+	if !ffmpegAvailable() {
+		return nil, ErrNoFFmpeg
+	}
+	if layout.Frames <= 0 {
+		return nil, errors.New("sprite sheets are disabled")
+	}
+	duration := probeDuration(filePath)
+	if duration == 0 {
+		return nil, fmt.Errorf("cannot find the length of %s", filePath)
+	}
+	size := layout.FrameSize
+	sheet := imaging.New(layout.Columns*size, layout.Rows*size, color.Black)
+	grabbed := 0
+	for i := 0; i < layout.Frames; i++ {
+		at := duration * (float64(i) + 0.5) / float64(layout.Frames)
+		frame, err := grabFrame(filePath, at, size)
+		if err != nil {
+			continue
+		}
+		frame = imaging.Thumbnail(frame, size, size, imaging.Linear)
+		sheet = imaging.Paste(sheet, frame, image.Pt((i%layout.Columns)*size, (i/layout.Columns)*size))
+		grabbed++
+	}
+	if grabbed == 0 {
+		return nil, fmt.Errorf("no frames could be read from %s", filePath)
+	}
+	return sheet, nil
+}
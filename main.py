@@ -5,6 +5,7 @@ import decky # type: ignore
 import socket
 from settings import SettingsManager # type: ignore
 import subprocess
+import threading
 from subprocess import PIPE
 
 settings = SettingsManager(
@@ -24,6 +25,16 @@ class Plugin:
     server_running = False
     _watchdog_task = None
     error: Union[str, None] = None
+    pin: Union[str, None] = None
+    fingerprint: Union[str, None] = None
+
+    def read_backend_output(self, backend):
+        for line in iter(backend.stdout.readline, b""):
+            text = line.decode(errors="replace").strip()
+            if text.startswith("PIN: "):
+                self.pin = text[len("PIN: "):]
+            elif text.startswith("FINGERPRINT: "):
+                self.fingerprint = text[len("FINGERPRINT: "):]
 
     async def watchdog(self):
         while True:
@@ -62,11 +73,19 @@ class Plugin:
                         "-t",
                         str(await Plugin.get_timeout(self) * 60),
                         ("", "-uploads")[await Plugin.get_uploads_enabled(self)],
-                        ("", "-disablethumbnails")[await Plugin.get_disable_thumbnails(self)]
+                        ("", "-write")[await Plugin.get_write_enabled(self)],
+                        ("", "-disablethumbnails")[await Plugin.get_disable_thumbnails(self)],
+                        "-state",
+                        decky.DECKY_PLUGIN_RUNTIME_DIR,
                     ],
                     stdout=PIPE,
                     stderr=subprocess.STDOUT,
                 )
+                threading.Thread(
+                    target=Plugin.read_backend_output,
+                    args=(self, self.backend),
+                    daemon=True,
+                ).start()
                 self.server_running = True
                 decky.logger.info("[set_server_running] Web service started")
                 await Plugin.set_history(self)
@@ -76,6 +95,7 @@ class Plugin:
                 decky.logger.info("[set_server_running] Stopping web service")
                 self.server_running = False
                 self.backend = None
+                self.pin = None
             return enable
         except Exception as e:
             decky.logger.error(f"[set_server_running]: {e}")
@@ -130,6 +150,14 @@ class Plugin:
         settings.commit()
         return enabled
 
+    async def get_write_enabled(self):
+        return settings.getSetting("WRITE", False)
+
+    async def set_write_enabled(self, enabled: bool):
+        settings.setSetting("WRITE", enabled)
+        settings.commit()
+        return enabled
+
     async def get_disable_thumbnails(self):
         return settings.getSetting("DISABLE_THUMBNAILS", False)
 
@@ -165,7 +193,10 @@ class Plugin:
             "error": await Plugin.get_error(self),
             "history": await Plugin.get_history(self),
             "allow_uploads": await Plugin.get_uploads_enabled(self),
-            "disable_thumbnails": await Plugin.get_disable_thumbnails(self)
+            "allow_write": await Plugin.get_write_enabled(self),
+            "disable_thumbnails": await Plugin.get_disable_thumbnails(self),
+            "pin": self.pin,
+            "fingerprint": self.fingerprint
         }
 
     async def set_status(self, status):
@@ -178,6 +209,8 @@ class Plugin:
                 await Plugin.set_timeout(self, status["timeout"])
             if "allow_uploads" in status:
                 await Plugin.set_uploads_enabled(self, status["allow_uploads"])
+            if "allow_write" in status:
+                await Plugin.set_write_enabled(self, status["allow_write"])
             if "server_running" in status:
                 await Plugin.set_server_running(self, status["server_running"])
             if "disable_thumbnails" in status:
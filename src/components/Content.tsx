@@ -23,6 +23,7 @@ export function Content() {
     port: 8000,
     timeout: 1,
     allow_uploads: false,
+    allow_write: false,
     ip_address: "127.0.0.1",
     accepted_warning: false,
     history: [],
@@ -79,6 +80,7 @@ export function Content() {
     timeout: number,
     directory: string,
     allow_uploads: boolean,
+    allow_write: boolean,
     disable_thumbnails: boolean,
   ) => {
     setServerStatus({
@@ -86,6 +88,7 @@ export function Content() {
       timeout: Number(timeout),
       directory,
       allow_uploads,
+      allow_write,
       disable_thumbnails,
     });
   };
@@ -112,6 +115,7 @@ export function Content() {
                 directory={state.directory}
                 history={state.history}
                 allow_uploads={state.allow_uploads}
+                allow_write={state.allow_write}
                 disable_thumbnails={state.disable_thumbnails}
                 handleSubmit={handleModalSubmit}
               />,
@@ -133,6 +137,26 @@ export function Content() {
         <Field inlineWrap="shift-children-below">
           http{state.allow_uploads ? "s" : ""}://{state.ip_address}:{state.port}
         </Field>
+        {state.server_running && state.pin ? (
+          <Field
+            inlineWrap="shift-children-below"
+            label="PIN"
+            bottomSeparator="none"
+          >
+            {state.pin}
+          </Field>
+        ) : null}
+        {state.server_running && state.fingerprint ? (
+          <Field
+            inlineWrap="shift-children-below"
+            label="Certificate Fingerprint"
+            bottomSeparator="none"
+          >
+            <div style={{ wordBreak: "break-all", fontSize: "0.8em" }}>
+              {state.fingerprint}
+            </div>
+          </Field>
+        ) : null}
         <Field
           inlineWrap="shift-children-below"
           label="Directory"
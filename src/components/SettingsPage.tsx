@@ -22,12 +22,14 @@ export const SettingsPage: VFC<{
   directory: string;
   history: string[];
   allow_uploads: boolean;
+  allow_write: boolean;
   disable_thumbnails: boolean;
   handleSubmit: (
     port: number,
     timeout: number,
     destination: string,
     allow_uploads: boolean,
+    allow_write: boolean,
     disable_thumbnails: boolean,
   ) => Promise<void>;
 }> = ({
@@ -37,6 +39,7 @@ export const SettingsPage: VFC<{
   directory,
   history,
   allow_uploads,
+  allow_write,
   disable_thumbnails,
   handleSubmit,
 }) => {
@@ -45,6 +48,7 @@ export const SettingsPage: VFC<{
     timeout,
     directory,
     allow_uploads,
+    allow_write,
     disable_thumbnails,
   });
   const [historySelection, setHistory] = useState("none");
@@ -98,6 +102,7 @@ export const SettingsPage: VFC<{
         form.timeout,
         form.directory,
         form.allow_uploads,
+        form.allow_write,
         form.disable_thumbnails,
       );
       closeModal?.();
@@ -229,6 +234,17 @@ export const SettingsPage: VFC<{
             }
           />
         </Field>
+        <Field label="Allow File Management" bottomSeparator="none">
+          <Toggle
+            value={form.allow_write}
+            onChange={(value) =>
+              setForm({
+                ...form,
+                allow_write: value,
+              })
+            }
+          />
+        </Field>
         <Field label="Disable Thumbnails" bottomSeparator="none">
           <Toggle
             value={form.disable_thumbnails}
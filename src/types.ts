@@ -4,9 +4,12 @@ export interface State {
   port: number;
   timeout: number;
   allow_uploads: boolean;
+  allow_write: boolean;
   ip_address: string;
   error?: string;
   accepted_warning: boolean;
   history: string[];
   disable_thumbnails: boolean;
+  pin?: string;
+  fingerprint?: string;
 }